@@ -0,0 +1,594 @@
+package MeloyApi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 访问日志格式
+const (
+	ACCESS_LOG_FORMAT_COMBINED = "combined"
+	ACCESS_LOG_FORMAT_JSON     = "json"
+	ACCESS_LOG_FORMAT_LOGFMT   = "logfmt"
+)
+
+// 缓存状态
+const (
+	ACCESS_LOG_CACHE_HIT         = "HIT"
+	ACCESS_LOG_CACHE_STALE       = "STALE"
+	ACCESS_LOG_CACHE_REVALIDATED = "REVALIDATED"
+	ACCESS_LOG_CACHE_MISS        = "MISS"
+	ACCESS_LOG_CACHE_BYPASS      = "BYPASS"
+)
+
+// 请求ID报头
+const ACCESS_LOG_REQUEST_ID_HEADER = "X-Request-Id"
+
+// 客户端提供的请求ID最大长度
+const ACCESS_LOG_MAX_REQUEST_ID_LENGTH = 128
+
+// 等待写入的日志数量，超出后丢弃
+const ACCESS_LOG_QUEUE_SIZE = 4096
+
+// 访问日志配置
+type AccessLogConfig struct {
+	On       bool   `json:"on"`       // 是否启用
+	Format   string `json:"format"`   // 格式：combined（默认）, json, logfmt
+	File     string `json:"file"`     // 文件名，相对于logs/目录，默认为access.log
+	MaxSize  string `json:"maxSize"`  // 单个文件的最大尺寸，比如 100m，超出后轮转
+	Rotate   string `json:"rotate"`   // 按时间轮转：hour, day，默认不按时间轮转
+	MaxFiles int    `json:"maxFiles"` // 保留的历史文件数，0表示不限制
+	MaxAge   string `json:"maxAge"`   // 历史文件保留时间，比如 7d，空表示不限制
+}
+
+// 单个请求的访问日志
+type AccessLogEntry struct {
+	Time         time.Time
+	RequestId    string
+	ClientIP     string
+	Method       string
+	URI          string
+	Proto        string
+	Referer      string
+	UserAgent    string
+	Consumer     string
+	Api          string
+	Server       string
+	UpstreamHost string
+	Status       int
+	Bytes        int64
+	DurationMs   float64
+	UpstreamMs   float64
+	CacheStatus  string
+
+	mutex sync.Mutex
+}
+
+// 访问日志管理器
+type AccessLogManager struct {
+	config   AccessLogConfig
+	maxBytes int64
+	maxAge   time.Duration
+
+	file     *os.File
+	filename string
+	size     int64
+	openedAt time.Time
+
+	queue   chan []byte
+	flushes chan chan bool
+	drops   int64
+
+	mutex sync.Mutex
+}
+
+type accessLogContextKey string
+
+const accessLogEntryContextKey accessLogContextKey = "entry"
+
+var accessLogManager = AccessLogManager{}
+
+// 重新加载配置
+func (manager *AccessLogManager) reload() {
+	config := appConfig.AccessLog
+
+	var maxBytes int64 = 0
+	if len(config.MaxSize) > 0 {
+		size, err := parseSizeFromString(config.MaxSize)
+		if err != nil {
+			log.Println("Parse "+config.MaxSize+" Error:", err.Error())
+		} else {
+			maxBytes = int64(size)
+		}
+	}
+
+	maxAge, err := parsePeriodFromString(config.MaxAge)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+
+	config.Format = strings.ToLower(config.Format)
+	if config.Format != ACCESS_LOG_FORMAT_JSON && config.Format != ACCESS_LOG_FORMAT_LOGFMT {
+		config.Format = ACCESS_LOG_FORMAT_COMBINED
+	}
+	config.Rotate = strings.ToLower(config.Rotate)
+	if len(config.File) == 0 {
+		config.File = "access.log"
+	}
+	filename := appManager.AppDir + string(os.PathSeparator) + "logs" + string(os.PathSeparator) + config.File
+
+	// 先写入原来配置下的日志
+	manager.flush()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.queue == nil {
+		manager.queue = make(chan []byte, ACCESS_LOG_QUEUE_SIZE)
+		manager.flushes = make(chan chan bool)
+		go manager.loop()
+	}
+
+	// 关闭或者更换文件
+	if manager.file != nil && (!config.On || manager.filename != filename) {
+		manager.file.Close()
+		manager.file = nil
+	}
+
+	manager.config = config
+	manager.maxBytes = maxBytes
+	manager.maxAge = maxAge
+	manager.filename = filename
+
+	if config.On && manager.file == nil {
+		err := manager.open()
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	}
+}
+
+// 是否启用
+func (manager *AccessLogManager) isOn() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.config.On && manager.file != nil
+}
+
+// 开始记录某个请求，返回带有日志条目的请求，没有启用时条目为nil
+func (manager *AccessLogManager) begin(request *http.Request, api string) (*AccessLogEntry, *http.Request) {
+	// 请求ID，客户端没有提供或者提供的不合法时自动生成，并转发给API服务器
+	requestId := request.Header.Get(ACCESS_LOG_REQUEST_ID_HEADER)
+	if !isValidRequestId(requestId) {
+		requestId = generateRequestId()
+		request.Header.Set(ACCESS_LOG_REQUEST_ID_HEADER, requestId)
+	}
+
+	if !manager.isOn() {
+		return nil, request
+	}
+
+	clientIP := request.RemoteAddr
+	if ip := parseRemoteIP(request.RemoteAddr); ip != nil {
+		clientIP = ip.String()
+	}
+
+	entry := &AccessLogEntry{
+		Time:      time.Now(),
+		RequestId: requestId,
+		ClientIP:  clientIP,
+		Method:    request.Method,
+		URI:       request.RequestURI,
+		Proto:     request.Proto,
+		Referer:   request.Referer(),
+		UserAgent: request.UserAgent(),
+		Consumer:  appManager.findConsumer(request),
+		Api:       api,
+	}
+	return entry, request.WithContext(context.WithValue(request.Context(), accessLogEntryContextKey, entry))
+}
+
+// 写入日志
+func (manager *AccessLogManager) write(entry *AccessLogEntry) {
+	if entry == nil {
+		return
+	}
+
+	manager.mutex.Lock()
+	format := manager.config.Format
+	manager.mutex.Unlock()
+
+	line := entry.format(format)
+	select {
+	case manager.queue <- []byte(line + "\n"):
+	default:
+		atomic.AddInt64(&manager.drops, 1)
+	}
+}
+
+// 把日志写入文件
+func (manager *AccessLogManager) loop() {
+	for {
+		select {
+		case data := <-manager.queue:
+			manager.mutex.Lock()
+			manager.writeFile(data)
+			manager.mutex.Unlock()
+		case done := <-manager.flushes:
+			manager.mutex.Lock()
+			for len(manager.queue) > 0 {
+				manager.writeFile(<-manager.queue)
+			}
+			if manager.file != nil {
+				manager.file.Sync()
+			}
+			manager.mutex.Unlock()
+			done <- true
+		}
+	}
+}
+
+// 写入所有等待中的日志，在关闭程序前调用
+func (manager *AccessLogManager) flush() {
+	manager.mutex.Lock()
+	flushes := manager.flushes
+	manager.mutex.Unlock()
+
+	if flushes == nil {
+		return
+	}
+
+	done := make(chan bool, 1)
+	select {
+	case flushes <- done:
+	case <-time.After(10 * time.Second):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// 写入文件，需要在锁内调用
+func (manager *AccessLogManager) writeFile(data []byte) {
+	if manager.file == nil {
+		return
+	}
+
+	if manager.shouldRotate(len(data)) {
+		err := manager.rotate()
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			if manager.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := manager.file.Write(data)
+	manager.size += int64(n)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+}
+
+// 打开日志文件
+func (manager *AccessLogManager) open() error {
+	file, err := os.OpenFile(manager.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	manager.file = file
+	manager.size = 0
+	manager.openedAt = time.Now()
+
+	stat, err := file.Stat()
+	if err == nil {
+		manager.size = stat.Size()
+		if manager.size > 0 {
+			manager.openedAt = stat.ModTime()
+		}
+	}
+	return nil
+}
+
+// 判断是否需要轮转
+func (manager *AccessLogManager) shouldRotate(length int) bool {
+	if manager.size == 0 {
+		return false
+	}
+	if manager.maxBytes > 0 && manager.size+int64(length) > manager.maxBytes {
+		return true
+	}
+
+	now := time.Now()
+	switch manager.config.Rotate {
+	case "hour":
+		return !now.Truncate(time.Hour).Equal(manager.openedAt.Truncate(time.Hour))
+	case "day":
+		return now.Year() != manager.openedAt.Year() || now.YearDay() != manager.openedAt.YearDay()
+	}
+	return false
+}
+
+// 轮转日志文件，把当前文件改名为"文件名-时间.扩展名"，然后清理过期的文件
+func (manager *AccessLogManager) rotate() error {
+	manager.file.Close()
+	manager.file = nil
+
+	ext := filepath.Ext(manager.filename)
+	base := strings.TrimSuffix(manager.filename, ext)
+	rotatedName := base + "-" + manager.openedAt.Format("20060102-150405") + ext
+	for index := 1; ; index++ {
+		if exists, _ := FileExists(rotatedName); !exists {
+			break
+		}
+		rotatedName = base + "-" + manager.openedAt.Format("20060102-150405") + "." + strconv.Itoa(index) + ext
+	}
+
+	err := os.Rename(manager.filename, rotatedName)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+
+	manager.clean()
+
+	return manager.open()
+}
+
+// 按照数量和时间清理历史文件
+func (manager *AccessLogManager) clean() {
+	files := manager.rotatedFiles()
+
+	// 新的在前
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	dir := filepath.Dir(manager.filename)
+	now := time.Now()
+	for index, file := range files {
+		isExpired := manager.maxAge > 0 && now.Sub(file.ModTime()) > manager.maxAge
+		isOverflow := manager.config.MaxFiles > 0 && index >= manager.config.MaxFiles
+		if isExpired || isOverflow {
+			err := os.Remove(dir + string(os.PathSeparator) + file.Name())
+			if err != nil {
+				log.Println("Error:" + err.Error())
+			}
+		}
+	}
+}
+
+// 所有轮转后的历史文件
+func (manager *AccessLogManager) rotatedFiles() []os.FileInfo {
+	ext := filepath.Ext(manager.filename)
+	prefix := strings.TrimSuffix(filepath.Base(manager.filename), ext) + "-"
+
+	result := []os.FileInfo{}
+	dir, err := os.Open(filepath.Dir(manager.filename))
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return result
+	}
+	defer dir.Close()
+
+	files, err := dir.Readdir(-1)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return result
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), prefix) || !strings.HasSuffix(file.Name(), ext) {
+			continue
+		}
+		result = append(result, file)
+	}
+	return result
+}
+
+// 取得请求中的日志条目
+func findAccessLogEntry(request *http.Request) *AccessLogEntry {
+	entry, ok := request.Context().Value(accessLogEntryContextKey).(*AccessLogEntry)
+	if !ok {
+		return nil
+	}
+	return entry
+}
+
+// 判断请求ID是否合法，只能包含字母、数字和-_.:，长度不超过ACCESS_LOG_MAX_REQUEST_ID_LENGTH
+func isValidRequestId(requestId string) bool {
+	if len(requestId) == 0 || len(requestId) > ACCESS_LOG_MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range requestId {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == ':' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// 生成请求ID
+func generateRequestId() string {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(data)
+}
+
+// 设置选取的API服务器
+func (entry *AccessLogEntry) setUpstream(address ApiAddress) {
+	if entry == nil {
+		return
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.Server = address.Server
+	entry.UpstreamHost = address.Host
+}
+
+// 设置API服务器的耗时
+func (entry *AccessLogEntry) setUpstreamDuration(duration time.Duration) {
+	if entry == nil {
+		return
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.UpstreamMs = float64(duration) / float64(time.Millisecond)
+}
+
+// 设置缓存状态
+func (entry *AccessLogEntry) setCacheStatus(cacheStatus string) {
+	if entry == nil {
+		return
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.CacheStatus = cacheStatus
+}
+
+// 请求结束
+func (entry *AccessLogEntry) finish(status int, bytes int64) {
+	if entry == nil {
+		return
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.Status = status
+	entry.Bytes = bytes
+	entry.DurationMs = float64(time.Since(entry.Time)) / float64(time.Millisecond)
+}
+
+// 格式化
+func (entry *AccessLogEntry) format(format string) string {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	switch format {
+	case ACCESS_LOG_FORMAT_JSON:
+		data, err := json.Marshal(entry.fields())
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			return ""
+		}
+		return string(data)
+	case ACCESS_LOG_FORMAT_LOGFMT:
+		pieces := []string{}
+		for _, field := range entry.fieldList() {
+			pieces = append(pieces, field[0]+"="+formatLogfmtValue(field[1]))
+		}
+		return strings.Join(pieces, " ")
+	}
+
+	// combined格式，后面附加网关相关的字段
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" \"%s\" \"%s\" \"%s\" %.3f %.3f %s",
+		entry.ClientIP,
+		formatCombinedValue(entry.Consumer),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method,
+		entry.URI,
+		entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		formatCombinedValue(entry.Referer),
+		formatCombinedValue(entry.UserAgent),
+		formatCombinedValue(entry.RequestId),
+		formatCombinedValue(entry.Api),
+		formatCombinedValue(entry.UpstreamHost),
+		entry.DurationMs/1000,
+		entry.UpstreamMs/1000,
+		formatCombinedValue(entry.CacheStatus))
+}
+
+// JSON格式的字段
+func (entry *AccessLogEntry) fields() Map {
+	return Map{
+		"time":         entry.Time.Format(time.RFC3339Nano),
+		"requestId":    entry.RequestId,
+		"clientIP":     entry.ClientIP,
+		"method":       entry.Method,
+		"uri":          entry.URI,
+		"proto":        entry.Proto,
+		"referer":      entry.Referer,
+		"userAgent":    entry.UserAgent,
+		"consumer":     entry.Consumer,
+		"api":          entry.Api,
+		"server":       entry.Server,
+		"upstreamHost": entry.UpstreamHost,
+		"status":       entry.Status,
+		"bytes":        entry.Bytes,
+		"durationMs":   entry.DurationMs,
+		"upstreamMs":   entry.UpstreamMs,
+		"cacheStatus":  entry.CacheStatus,
+	}
+}
+
+// logfmt格式的字段，保持固定的顺序
+func (entry *AccessLogEntry) fieldList() [][2]string {
+	return [][2]string{
+		{"time", entry.Time.Format(time.RFC3339Nano)},
+		{"request_id", entry.RequestId},
+		{"client_ip", entry.ClientIP},
+		{"method", entry.Method},
+		{"uri", entry.URI},
+		{"proto", entry.Proto},
+		{"referer", entry.Referer},
+		{"user_agent", entry.UserAgent},
+		{"consumer", entry.Consumer},
+		{"api", entry.Api},
+		{"server", entry.Server},
+		{"upstream_host", entry.UpstreamHost},
+		{"status", strconv.Itoa(entry.Status)},
+		{"bytes", strconv.FormatInt(entry.Bytes, 10)},
+		{"duration_ms", strconv.FormatFloat(entry.DurationMs, 'f', 3, 64)},
+		{"upstream_ms", strconv.FormatFloat(entry.UpstreamMs, 'f', 3, 64)},
+		{"cache_status", entry.CacheStatus},
+	}
+}
+
+// logfmt中的值，包含空格、引号或者等号时加引号
+func formatLogfmtValue(value string) string {
+	if len(value) == 0 {
+		return "\"\""
+	}
+	if strings.ContainsAny(value, " \"=\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// combined格式中的值，为空时用"-"代替，并转义引号
+func formatCombinedValue(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return strings.NewReplacer("\"", "\\\"", "\n", "\\n", "\r", "\\r").Replace(value)
+}
@@ -0,0 +1,211 @@
+package MeloyApi
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 客户端列表配置
+type ClientListConfig struct {
+	Clients []string `json:"clients"` // IP或者CIDR，比如 192.168.1.100, 10.0.0.0/8, ::1, fd00::/8
+	Files   []string `json:"files"`   // 包含IP或者CIDR的文件，每行一个，支持#注释
+}
+
+// 客户端列表
+type ClientList struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+// 客户端过滤器
+type ClientFilter struct {
+	allow *ClientList
+	deny  *ClientList
+
+	denyAll bool // 配置有错误时禁止所有客户端访问
+}
+
+// 从配置构造客户端列表，如果配置为空则返回nil
+func newClientList(config ClientListConfig) (list *ClientList, err error) {
+	if len(config.Clients) == 0 && len(config.Files) == 0 {
+		return
+	}
+
+	list = &ClientList{
+		ips: map[string]bool{},
+	}
+
+	for _, client := range config.Clients {
+		err = list.add(client)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, file := range config.Files {
+		err = list.addFile(file)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// 添加IP或者CIDR
+func (list *ClientList) add(client string) error {
+	client = strings.TrimSpace(client)
+	if len(client) == 0 {
+		return nil
+	}
+
+	if strings.Contains(client, "/") {
+		_, ipNet, err := net.ParseCIDR(client)
+		if err != nil {
+			return err
+		}
+		list.nets = append(list.nets, ipNet)
+		return nil
+	}
+
+	ip := net.ParseIP(strings.Trim(client, "[]"))
+	if ip == nil {
+		return errors.New("invalid client ip '" + client + "'")
+	}
+	list.ips[ip.String()] = true
+	return nil
+}
+
+// 从文件中加载IP或者CIDR
+func (list *ClientList) addFile(file string) error {
+	if !filepath.IsAbs(file) {
+		file = appManager.AppDir + string(os.PathSeparator) + file
+	}
+
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+
+		err = list.add(line)
+		if err != nil {
+			return errors.New(file + ":" + err.Error())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// 判断是否包含某个IP
+func (list *ClientList) contains(ip net.IP) bool {
+	if list == nil || ip == nil {
+		return false
+	}
+
+	if list.ips[ip.String()] {
+		return true
+	}
+
+	for _, ipNet := range list.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 从允许和禁止的配置构造过滤器，如果都为空则返回nil
+// 配置有错误时返回禁止所有客户端访问的过滤器，避免错误的配置放开访问
+func newClientFilter(allow ClientListConfig, deny ClientListConfig) (filter *ClientFilter, err error) {
+	allowList, err := newClientList(allow)
+	if err != nil {
+		filter = &ClientFilter{denyAll: true}
+		return
+	}
+
+	denyList, err := newClientList(deny)
+	if err != nil {
+		filter = &ClientFilter{denyAll: true}
+		return
+	}
+
+	if allowList == nil && denyList == nil {
+		return
+	}
+
+	filter = &ClientFilter{
+		allow: allowList,
+		deny:  denyList,
+	}
+	return
+}
+
+// 判断IP是否允许访问
+func (filter *ClientFilter) allows(ip net.IP) bool {
+	if filter == nil {
+		return true
+	}
+
+	if filter.denyAll || ip == nil {
+		return false
+	}
+
+	// 禁止的
+	if filter.deny != nil && filter.deny.contains(ip) {
+		return false
+	}
+
+	// 支持的
+	if filter.allow != nil && !filter.allow.contains(ip) {
+		return false
+	}
+
+	return true
+}
+
+// 合并过滤器，other中设置的允许和禁止列表会覆盖当前的
+func (filter *ClientFilter) override(other *ClientFilter) *ClientFilter {
+	if other == nil {
+		return filter
+	}
+	if filter == nil || other.denyAll {
+		return other
+	}
+	if filter.denyAll {
+		return filter
+	}
+
+	result := &ClientFilter{
+		allow: filter.allow,
+		deny:  filter.deny,
+	}
+	if other.allow != nil {
+		result.allow = other.allow
+	}
+	if other.deny != nil {
+		result.deny = other.deny
+	}
+	return result
+}
+
+// 分析请求的客户端IP，支持IPv4和带方括号的IPv6
+func parseRemoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
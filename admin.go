@@ -5,17 +5,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"bytes"
 	"net/http/httputil"
 	"io"
+	"errors"
 	"compress/gzip"
 )
 
@@ -30,15 +33,10 @@ type AdminConfig struct {
 		Key  string
 	}
 
-	Allow struct {
-		Clients []string
-	}
-	Deny struct {
-		Clients []string
-	}
+	Allow ClientListConfig
+	Deny  ClientListConfig
 
-	hasAllow bool
-	hasDeny  bool
+	clientFilter *ClientFilter
 }
 
 var adminConfig AdminConfig
@@ -67,8 +65,11 @@ func (manager *AdminManager) Load(appDir string) {
 		return
 	}
 
-	adminConfig.hasAllow = len(adminConfig.Allow.Clients) > 0
-	adminConfig.hasDeny = len(adminConfig.Deny.Clients) > 0
+	adminConfig.clientFilter, err = newClientFilter(adminConfig.Allow, adminConfig.Deny)
+	if err != nil {
+		log.Println("Error:" + err.Error() + ", admin server will not start")
+		return
+	}
 
 	address := fmt.Sprintf("%s:%d", adminConfig.Host, adminConfig.Port)
 	log.Println("start " + address)
@@ -200,6 +201,26 @@ func (manager *AdminManager) handleRequest(writer http.ResponseWriter, request *
 		}
 	}
 
+	// API时间范围统计
+	{
+		reg, _ := regexp.Compile("^/@api/\\[(.+)]/stat$")
+		matches := reg.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			manager.handleApiStatRange(writer, request, matches[1])
+			return
+		}
+	}
+
+	// 客户端排行
+	{
+		reg, _ := regexp.Compile("^/@api/\\[(.+)]/talkers/(ip|consumer|userAgent)$")
+		matches := reg.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			manager.handleTalkers(writer, request, matches[1], matches[2])
+			return
+		}
+	}
+
 	// API请求测试
 	{
 		reg, _ := regexp.Compile("^/@api/\\[(.+)]/request/host/(\\d+)$")
@@ -270,6 +291,30 @@ func (manager *AdminManager) handleRequest(writer http.ResponseWriter, request *
 		}
 	}
 
+	if path == "/@cache/stat" {
+		manager.handleCacheStat(writer, request)
+		return
+	}
+
+	if path == "/@cache/keys" {
+		manager.handleCacheKeys(writer, request)
+		return
+	}
+
+	if path == "/@cache/purge" {
+		manager.handleCachePurge(writer, request)
+		return
+	}
+
+	{
+		reg, _ := regexp.Compile("^/@cache/key/(.+)$")
+		matches := reg.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			manager.handleCacheKey(writer, request, matches[1])
+			return
+		}
+	}
+
 	{
 		reg, _ := regexp.Compile("^/@cache/\\[(.+)]/clear$")
 		matches := reg.FindStringSubmatch(path)
@@ -302,6 +347,11 @@ func (manager *AdminManager) handleRequest(writer http.ResponseWriter, request *
 		return
 	}
 
+	if path == "/metrics" {
+		manager.handleMetrics(writer, request)
+		return
+	}
+
 	if path == "/@monitor" {
 		manager.handleMonitor(writer, request)
 		return
@@ -332,6 +382,29 @@ func (manager *AdminManager) handleRequest(writer http.ResponseWriter, request *
 		return
 	}
 
+	{
+		reg, _ := regexp.Compile("^/@api/stat/rank/(requests|hits|errors|cost)$")
+		matches := reg.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			manager.handleStatRangeRank(writer, request, matches[1])
+			return
+		}
+	}
+
+	{
+		reg, _ := regexp.Compile("^/@api/talkers/(ip|consumer|userAgent)$")
+		matches := reg.FindStringSubmatch(path)
+		if len(matches) > 0 {
+			manager.handleTalkers(writer, request, "", matches[1])
+			return
+		}
+	}
+
+	if path == "/@alerts" {
+		manager.handleAlerts(writer, request)
+		return
+	}
+
 	if path == "/@api/watch" {
 		manager.handleWatch(writer, request)
 		return
@@ -410,11 +483,31 @@ func (manager *AdminManager) handleApiDay(writer http.ResponseWriter, request *h
 			"requests": apiStat.Requests,
 			"hits":     apiStat.Hits,
 			"errors":   apiStat.Errors,
+			"p50":      apiStat.P50,
+			"p90":      apiStat.P90,
+			"p95":      apiStat.P95,
+			"p99":      apiStat.P99,
 			"minutes":  minutes,
 		},
 	})
 }
 
+// /@api/[:path]/stat?from=:from&to=:to&interval=:interval&group=:group
+// 时间范围统计
+func (manager *AdminManager) handleApiStatRange(writer http.ResponseWriter, request *http.Request, path string) {
+	statRange, err := parseStatRange(request.URL.Query())
+	if err != nil {
+		manager.writeErrorMessage(writer, request, err)
+		return
+	}
+
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data":    statManager.findSeries(path, statRange),
+	})
+}
+
 // /@api/[:path]/host/:hostIndex
 // 基准测试
 func (manager *AdminManager) handleApiRequest(writer http.ResponseWriter, request *http.Request, path string, hostIndex int) {
@@ -803,6 +896,167 @@ func (manager *AdminManager) handleCacheClear(writer http.ResponseWriter, reques
 	})
 }
 
+// /@cache/stat
+// 缓存统计信息
+func (manager *AdminManager) handleCacheStat(writer http.ResponseWriter, request *http.Request) {
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data":    cacheManager.stat(),
+	})
+}
+
+// /@cache/keys?offset=:offset&size=:size&prefix=:prefix&pattern=:pattern
+// 分页列出缓存的键，可以使用前缀或者带*的通配符过滤
+func (manager *AdminManager) handleCacheKeys(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	prefix := query.Get("prefix")
+	pattern := query.Get("pattern")
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	size, _ := strconv.Atoi(query.Get("size"))
+	if size <= 0 {
+		size = 100
+	} else if size > 1000 {
+		size = 1000
+	}
+
+	keys := cacheManager.keys(func(key string) bool {
+		if len(prefix) > 0 && !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if len(pattern) > 0 && !matchWildcard(pattern, key) {
+			return false
+		}
+		return true
+	})
+
+	total := len(keys)
+	if offset > total {
+		offset = total
+	}
+	end := offset + size
+	if end > total {
+		end = total
+	}
+
+	items := []Map{}
+	for _, key := range keys[offset:end] {
+		items = append(items, cacheManager.summary(key))
+	}
+
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data": Map{
+			"total":  total,
+			"offset": offset,
+			"size":   size,
+			"keys":   items,
+		},
+	})
+}
+
+// /@cache/key/:key
+// 查看某个缓存条目，键中的?等特殊字符需要URL编码
+func (manager *AdminManager) handleCacheKey(writer http.ResponseWriter, request *http.Request, key string) {
+	entry, tier, ok := cacheManager.peek(key)
+	if !ok {
+		manager.printJSON(writer, request, Map{
+			"code":    404,
+			"message": "Not found",
+			"data":    nil,
+		})
+		return
+	}
+
+	encodings := []string{}
+	for encoding := range entry.Variants {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+
+	nowMs := time.Now().UnixNano() / 1000000
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data": Map{
+			"key":          entry.Key,
+			"tier":         tier,
+			"statusCode":   entry.StatusCode,
+			"size":         entry.Size,
+			"bodySize":     len(entry.Bytes),
+			"header":       entry.Header,
+			"tags":         entry.Tags,
+			"vary":         entry.Vary,
+			"etag":         entry.ETag,
+			"lastModified": entry.LastModified,
+			"encodings":    encodings,
+			"lifeMs":       entry.LifeMs,
+			"ttlMs":        entry.ExpiredAtMs - nowMs,
+			"staleMs":      entry.StaleMs,
+			"isStale":      entry.ExpiredAtMs < nowMs,
+			"expiredAt":    entry.ExpiredAtMs / 1000,
+		},
+	})
+}
+
+// /@cache/purge?prefix=:prefix&pattern=:pattern&regexp=:regexp
+// 删除匹配的缓存条目
+func (manager *AdminManager) handleCachePurge(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	prefix := query.Get("prefix")
+	pattern := query.Get("pattern")
+	regexpString := query.Get("regexp")
+
+	if len(prefix) == 0 && len(pattern) == 0 && len(regexpString) == 0 {
+		manager.printJSON(writer, request, Map{
+			"code":    400,
+			"message": "Require 'prefix', 'pattern' or 'regexp'",
+			"data":    nil,
+		})
+		return
+	}
+
+	var reg *regexp.Regexp
+	if len(regexpString) > 0 {
+		var err error
+		reg, err = regexp.Compile(regexpString)
+		if err != nil {
+			manager.printJSON(writer, request, Map{
+				"code":    400,
+				"message": "Invalid regexp:" + err.Error(),
+				"data":    nil,
+			})
+			return
+		}
+	}
+
+	count := cacheManager.purge(func(key string) bool {
+		if len(prefix) > 0 && !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if len(pattern) > 0 && !matchWildcard(pattern, key) {
+			return false
+		}
+		if reg != nil && !reg.MatchString(key) {
+			return false
+		}
+		return true
+	})
+
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data": Map{
+			"count": count,
+		},
+	})
+}
+
 // /@cache/[:path]/clear
 // 清除某个API对应的所有Cache
 func (manager *AdminManager) handleCacheClearPath(writer http.ResponseWriter, request *http.Request, path string) {
@@ -896,6 +1150,13 @@ func (manager *AdminManager) handleGitPull(writer http.ResponseWriter, request *
 	})
 }
 
+// /metrics
+// 以Prometheus文本格式输出监控指标
+func (manager *AdminManager) handleMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsManager.write(writer)
+}
+
 // /@monitor
 // 监控信息
 func (manager *AdminManager) handleMonitor(writer http.ResponseWriter, request *http.Request) {
@@ -943,6 +1204,7 @@ func (manager *AdminManager) handleMonitor(writer http.ResponseWriter, request *
 	}()
 
 	stat, _ := statManager.findStat()
+	concurrency, inFlight, queued := concurrencyManager.stat()
 
 	manager.printJSON(writer, request, Map{
 		"code":    200,
@@ -961,6 +1223,9 @@ func (manager *AdminManager) handleMonitor(writer http.ResponseWriter, request *
 			"hitsPercent":     stat["hits"],
 			"errorsPercent":   stat["errors"],
 			"cost":            stat["ms"],
+			"inFlight":        inFlight,
+			"queued":          queued,
+			"concurrency":     concurrency,
 		},
 	})
 }
@@ -1008,7 +1273,14 @@ func (manager *AdminManager) handleStatHitsRank(writer http.ResponseWriter, requ
 // /@api/stat/errors/rank
 // 错误数排行
 func (manager *AdminManager) handleStatErrorsRank(writer http.ResponseWriter, request *http.Request) {
-	apis, err := statManager.findErrorsRank(10)
+	// 作为错误统计的状态分类，比如statuses=5xx,gateway
+	classes := []string{}
+	statuses := request.URL.Query().Get("statuses")
+	if len(statuses) > 0 {
+		classes = strings.Split(statuses, ",")
+	}
+
+	apis, err := statManager.findErrorsRank(10, classes)
 	if err != nil {
 		manager.writeErrorMessage(writer, request, err)
 		return
@@ -1035,6 +1307,38 @@ func (manager *AdminManager) handleStatCostRank(writer http.ResponseWriter, requ
 	})
 }
 
+// /@api/stat/rank/:kind?from=:from&to=:to&group=:group&size=:size&statuses=:statuses
+// 时间范围内的排行，kind为requests、hits、errors或者cost
+func (manager *AdminManager) handleStatRangeRank(writer http.ResponseWriter, request *http.Request, kind string) {
+	query := request.URL.Query()
+	statRange, err := parseStatRange(query)
+	if err != nil {
+		manager.writeErrorMessage(writer, request, err)
+		return
+	}
+
+	size := 10
+	if len(query.Get("size")) > 0 {
+		size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || size <= 0 {
+			manager.writeErrorMessage(writer, request, errors.New("invalid size '"+query.Get("size")+"'"))
+			return
+		}
+	}
+
+	classes := []string{}
+	statuses := query.Get("statuses")
+	if len(statuses) > 0 {
+		classes = strings.Split(statuses, ",")
+	}
+
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data":    statManager.findRangeRank(kind, statRange, size, classes),
+	})
+}
+
 // /@api/watch
 // 监控日志
 func (manager *AdminManager) handleWatch(writer http.ResponseWriter, request *http.Request) {
@@ -1060,44 +1364,74 @@ func (manager *AdminManager) handleWatchClear(writer http.ResponseWriter, reques
 	})
 }
 
+// /@api/[:path]/talkers/:kind
+// /@api/talkers/:kind
+// 请求最多的客户端IP、消费者或者User-Agent
+func (manager *AdminManager) handleTalkers(writer http.ResponseWriter, request *http.Request, path string, kind string) {
+	query := request.URL.Query()
+
+	window := query.Get("window")
+	if len(window) == 0 {
+		window = TALKER_WINDOW_HOUR
+	}
+
+	size := 10
+	if len(query.Get("size")) > 0 {
+		var err error
+		size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || size <= 0 {
+			manager.writeErrorMessage(writer, request, errors.New("invalid size '"+query.Get("size")+"'"))
+			return
+		}
+	}
+
+	result, err := talkerManager.top(path, kind, window, size, time.Now())
+	if err != nil {
+		manager.writeErrorMessage(writer, request, err)
+		return
+	}
+
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data":    result,
+	})
+}
+
+// /@alerts
+// 告警规则和当前的告警
+func (manager *AdminManager) handleAlerts(writer http.ResponseWriter, request *http.Request) {
+	manager.printJSON(writer, request, Map{
+		"code":    200,
+		"message": "Success",
+		"data": Map{
+			"rules":  alertManager.rules(),
+			"alerts": alertManager.list(),
+		},
+	})
+}
+
 // 校验请求
 func (manager *AdminManager) validateRequest(writer http.ResponseWriter, request *http.Request) bool {
-	if !adminConfig.hasAllow && !adminConfig.hasDeny {
+	if adminConfig.clientFilter == nil {
 		return true
 	}
 
-	reg, _ := ReuseRegexpCompile(":\\d+$")
-	ip := reg.ReplaceAllString(request.RemoteAddr, "")
+	ip := parseRemoteIP(request.RemoteAddr)
 
 	//本地的
-	if adminConfig.Host == "0.0.0.0" && ip == "[::1]" {
+	if adminConfig.Host == "0.0.0.0" && ip != nil && ip.Equal(net.IPv6loopback) {
 		return true
 	}
 
-	//禁止的
-	if adminConfig.hasDeny {
-		if containsString(adminConfig.Deny.Clients, ip) {
-			manager.printJSON(writer, request, Map{
-				"code":    403,
-				"message": "Forbidden",
-				"data":    nil,
-			})
-
-			return false
-		}
-	}
-
-	//支持的
-	if adminConfig.hasAllow {
-		if !containsString(adminConfig.Allow.Clients, ip) {
-			manager.printJSON(writer, request, Map{
-				"code":    403,
-				"message": "Forbidden",
-				"data":    nil,
-			})
+	if !adminConfig.clientFilter.allows(ip) {
+		manager.printJSON(writer, request, Map{
+			"code":    403,
+			"message": "Forbidden",
+			"data":    nil,
+		})
 
-			return false
-		}
+		return false
 	}
 
 	return true
@@ -0,0 +1,494 @@
+package MeloyApi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iwind/MeloyApi/plugins"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 告警规则类型
+const (
+	ALERT_TYPE_ERROR_RATE   = "errorRate"   // 错误率
+	ALERT_TYPE_P95          = "p95"         // 耗时的95%百分位数
+	ALERT_TYPE_REQUEST_DROP = "requestDrop" // 请求数下降
+	ALERT_TYPE_HOST_DOWN    = "hostDown"    // API服务器主机不可用
+	ALERT_TYPE_HIT_DROP     = "hitDrop"     // 缓存命中率下降
+)
+
+// 告警状态
+const (
+	ALERT_STATE_PENDING  = "pending"
+	ALERT_STATE_FIRING   = "firing"
+	ALERT_STATE_RESOLVED = "resolved"
+)
+
+// 各类型规则的默认阈值
+var alertDefaultThresholds = map[string]float64{
+	ALERT_TYPE_ERROR_RATE:   5,
+	ALERT_TYPE_P95:          1000,
+	ALERT_TYPE_REQUEST_DROP: 50,
+	ALERT_TYPE_HOST_DOWN:    100,
+	ALERT_TYPE_HIT_DROP:     20,
+}
+
+const ALERT_DEFAULT_WINDOW = 5 * time.Minute
+const ALERT_DEFAULT_COMPARE = 24 * time.Hour
+const ALERT_DEFAULT_MIN_REQUESTS = 10
+
+// 已经恢复的告警保留的时间
+const ALERT_RESOLVED_KEEP = 24 * time.Hour
+
+// 告警配置
+type AlertConfig struct {
+	Rules  []AlertRuleConfig    `json:"rules"`
+	Notify plugins.NotifyConfig `json:"notify"` // 默认的通知方式
+}
+
+// 告警规则配置
+type AlertRuleConfig struct {
+	Name        string               `json:"name"`        // 名称，必须唯一
+	Type        string               `json:"type"`        // 类型：errorRate、p95、requestDrop、hostDown、hitDrop
+	Api         string               `json:"api"`         // 只检查某个API，为空时分别检查每个API
+	Threshold   float64              `json:"threshold"`   // 阈值
+	Statuses    []string             `json:"statuses"`    // errorRate中作为错误统计的状态分类，比如5xx、gateway
+	Window      string               `json:"window"`      // 统计的时间范围，默认为5m
+	For         string               `json:"for"`         // 持续超出阈值多长时间后才触发，默认为立即触发
+	Compare     string               `json:"compare"`     // requestDrop和hitDrop中对比的之前的时间，默认为1d
+	MinRequests int64                `json:"minRequests"` // 请求数少于此值时不检查，默认为10
+	Repeat      string               `json:"repeat"`      // 持续触发时重复通知的间隔，默认不重复
+	Notify      plugins.NotifyConfig `json:"notify"`      // 通知方式，为空时使用默认的通知方式
+
+	window      time.Duration
+	forDuration time.Duration
+	compare     time.Duration
+	repeat      time.Duration
+}
+
+// 告警
+type Alert struct {
+	Rule       string  `json:"rule"`
+	Type       string  `json:"type"`
+	Subject    string  `json:"subject"` // API路径，hostDown中为主机地址
+	State      string  `json:"state"`
+	Value      float64 `json:"value"`
+	Threshold  float64 `json:"threshold"`
+	Message    string  `json:"message"`
+	PendingAt  int64   `json:"pendingAt"`
+	FiredAt    int64   `json:"firedAt"`
+	ResolvedAt int64   `json:"resolvedAt"`
+	NotifiedAt int64   `json:"notifiedAt"`
+}
+
+// 一次检查的结果
+type alertObservation struct {
+	value   float64
+	matched bool
+	message string
+}
+
+// 告警管理器
+type AlertManager struct {
+	config AlertConfig
+	alerts map[string]*Alert // rule$$subject => alert
+
+	mutex sync.Mutex
+}
+
+var alertManager = AlertManager{
+	alerts: map[string]*Alert{},
+}
+
+// 从 config/alerts.json 中加载告警规则，文件不存在时不启用告警
+func (manager *AlertManager) load(appDir string) {
+	config := AlertConfig{}
+
+	configBytes, err := ioutil.ReadFile(appDir + "/config/alerts.json")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error:" + err.Error())
+		}
+	} else {
+		// 删除注释
+		jsonString := string(configBytes)
+		commentReg, err := ReuseRegexpCompile("/([*]+((.|\n|\r)+?)[*]+/)|(\n\\s+//.+)")
+		if err != nil {
+			log.Printf("Error:%s\n", err)
+		} else {
+			jsonString = commentReg.ReplaceAllString(jsonString, "")
+		}
+
+		err = json.Unmarshal([]byte(jsonString), &config)
+		if err != nil {
+			log.Println("Error:alerts:" + err.Error())
+			return
+		}
+	}
+
+	rules := []AlertRuleConfig{}
+	names := map[string]bool{}
+	for _, rule := range config.Rules {
+		err := rule.init()
+		if err != nil {
+			log.Println("Error:alert '" + rule.Name + "':" + err.Error())
+			continue
+		}
+		if names[rule.Name] {
+			log.Println("Error:alert '" + rule.Name + "':duplicate name")
+			continue
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	config.Rules = rules
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.config = config
+
+	// 删除已经不存在的规则的告警
+	for key, alert := range manager.alerts {
+		if !names[alert.Rule] {
+			delete(manager.alerts, key)
+		}
+	}
+}
+
+// 检查并初始化规则
+func (rule *AlertRuleConfig) init() (err error) {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if len(rule.Name) == 0 {
+		return errors.New("'name' should not be empty")
+	}
+
+	defaultThreshold, ok := alertDefaultThresholds[rule.Type]
+	if !ok {
+		return errors.New("invalid type '" + rule.Type + "'")
+	}
+	if rule.Threshold <= 0 {
+		rule.Threshold = defaultThreshold
+	}
+	if rule.MinRequests <= 0 {
+		rule.MinRequests = ALERT_DEFAULT_MIN_REQUESTS
+	}
+
+	rule.window, err = parsePeriodFromString(rule.Window)
+	if err != nil {
+		return
+	}
+	if rule.window < time.Minute {
+		rule.window = ALERT_DEFAULT_WINDOW
+	}
+	rule.window = rule.window.Truncate(time.Minute)
+
+	rule.compare, err = parsePeriodFromString(rule.Compare)
+	if err != nil {
+		return
+	}
+	if rule.compare < time.Minute {
+		rule.compare = ALERT_DEFAULT_COMPARE
+	}
+
+	rule.forDuration, err = parsePeriodFromString(rule.For)
+	if err != nil {
+		return
+	}
+
+	rule.repeat, err = parsePeriodFromString(rule.Repeat)
+	return
+}
+
+// 检查所有规则，在每分钟导出统计数据之后调用
+func (manager *AlertManager) evaluate(now time.Time) {
+	manager.mutex.Lock()
+	config := manager.config
+	manager.mutex.Unlock()
+
+	if len(config.Rules) == 0 {
+		return
+	}
+
+	// 统计数据按分钟记录，最近一分钟的数据记录在当前分钟
+	to := truncateStatTime(now, STAT_GRANULARITY_MINUTE).Add(time.Minute)
+
+	// 一次读取所有规则需要的数据
+	from := to
+	for _, rule := range config.Rules {
+		ruleFrom := to.Add(-rule.window)
+		if rule.Type == ALERT_TYPE_REQUEST_DROP || rule.Type == ALERT_TYPE_HIT_DROP {
+			ruleFrom = ruleFrom.Add(-rule.compare)
+		}
+		if ruleFrom.Before(from) {
+			from = ruleFrom
+		}
+	}
+	rows := []StatRow{}
+	statManager.walkRange(StatRange{From: from, To: to}, "", func(row StatRow, _ time.Duration) {
+		rows = append(rows, row)
+	})
+
+	for _, rule := range config.Rules {
+		observations := rule.observe(rows, to)
+
+		notify := rule.Notify
+		if notify.IsEmpty() {
+			notify = config.Notify
+		}
+		manager.update(rule, observations, now, notify)
+	}
+}
+
+// 根据统计数据计算每个对象的值
+func (rule AlertRuleConfig) observe(rows []StatRow, to time.Time) map[string]alertObservation {
+	observations := map[string]alertObservation{}
+
+	group := STAT_GROUP_API
+	if rule.Type == ALERT_TYPE_HOST_DOWN {
+		group = STAT_GROUP_HOST
+	}
+	current := aggregateAlertRows(rows, to.Add(-rule.window), to, rule.Api, group)
+
+	switch rule.Type {
+	case ALERT_TYPE_ERROR_RATE:
+		for subject, data := range current {
+			if data.Requests < rule.MinRequests {
+				continue
+			}
+			value := float64(countStatErrors(*data, rule.Statuses)) * 100 / float64(data.Requests)
+			observations[subject] = alertObservation{
+				value:   value,
+				matched: value > rule.Threshold,
+				message: fmt.Sprintf("error rate of '%s' is %.2f%% in last %s (threshold %.2f%%)", subject, value, formatStatInterval(rule.window), rule.Threshold),
+			}
+		}
+	case ALERT_TYPE_P95:
+		for subject, data := range current {
+			if data.Requests < rule.MinRequests {
+				continue
+			}
+			value := float64(data.Histogram.percentiles().P95)
+			observations[subject] = alertObservation{
+				value:   value,
+				matched: value > rule.Threshold,
+				message: fmt.Sprintf("p95 latency of '%s' is %.0fms in last %s (threshold %.0fms)", subject, value, formatStatInterval(rule.window), rule.Threshold),
+			}
+		}
+	case ALERT_TYPE_HOST_DOWN:
+		for subject, data := range current {
+			// 网关在选取主机之前拒绝的请求没有主机
+			if len(subject) == 0 || data.Requests < rule.MinRequests {
+				continue
+			}
+			value := float64(data.StatusCodes[0]) * 100 / float64(data.Requests)
+			observations[subject] = alertObservation{
+				value:   value,
+				matched: value >= rule.Threshold,
+				message: fmt.Sprintf("%.2f%% of requests to host '%s' (server '%s') failed in last %s (threshold %.2f%%)", value, subject, data.Server, formatStatInterval(rule.window), rule.Threshold),
+			}
+		}
+	case ALERT_TYPE_REQUEST_DROP, ALERT_TYPE_HIT_DROP:
+		baseline := aggregateAlertRows(rows, to.Add(-rule.window-rule.compare), to.Add(-rule.compare), rule.Api, group)
+		for subject, baselineData := range baseline {
+			if baselineData.Requests < rule.MinRequests {
+				continue
+			}
+
+			data, ok := current[subject]
+			if !ok {
+				data = &StatData{}
+			}
+
+			if rule.Type == ALERT_TYPE_REQUEST_DROP {
+				value := float64(baselineData.Requests-data.Requests) * 100 / float64(baselineData.Requests)
+				observations[subject] = alertObservation{
+					value:   value,
+					matched: value >= rule.Threshold,
+					message: fmt.Sprintf("requests of '%s' dropped %.2f%% (%d => %d) in last %s compared with %s ago (threshold %.2f%%)", subject, value, baselineData.Requests, data.Requests, formatStatInterval(rule.window), formatStatInterval(rule.compare), rule.Threshold),
+				}
+				continue
+			}
+
+			if data.Requests < rule.MinRequests {
+				continue
+			}
+			baselineRate := float64(baselineData.Hits) * 100 / float64(baselineData.Requests)
+			currentRate := float64(data.Hits) * 100 / float64(data.Requests)
+			value := baselineRate - currentRate
+			observations[subject] = alertObservation{
+				value:   value,
+				matched: value >= rule.Threshold,
+				message: fmt.Sprintf("cache hit rate of '%s' dropped from %.2f%% to %.2f%% in last %s compared with %s ago (threshold %.2f)", subject, baselineRate, currentRate, formatStatInterval(rule.window), formatStatInterval(rule.compare), rule.Threshold),
+			}
+		}
+	}
+
+	return observations
+}
+
+// 按照分组合并某个时间范围内的统计数据
+func aggregateAlertRows(rows []StatRow, from time.Time, to time.Time, path string, group string) map[string]*StatData {
+	result := map[string]*StatData{}
+	for _, row := range rows {
+		if row.Time.Before(from) || !row.Time.Before(to) {
+			continue
+		}
+		if len(path) > 0 && row.Path != path {
+			continue
+		}
+
+		subject := statGroupName(row.StatData, group)
+		data, ok := result[subject]
+		if !ok {
+			data = &StatData{
+				Server:      row.Server,
+				Histogram:   newStatHistogram(),
+				StatusCodes: StatStatusCodes{},
+			}
+			result[subject] = data
+		}
+		data.merge(row.StatData)
+	}
+	return result
+}
+
+// 根据检查结果更新告警状态，并在触发和恢复时发送通知
+func (manager *AlertManager) update(rule AlertRuleConfig, observations map[string]alertObservation, now time.Time, notify plugins.NotifyConfig) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	// 没有检查结果的已有告警视为恢复
+	subjects := map[string]bool{}
+	for subject := range observations {
+		subjects[subject] = true
+	}
+	for _, alert := range manager.alerts {
+		if alert.Rule == rule.Name {
+			subjects[alert.Subject] = true
+		}
+	}
+
+	for subject := range subjects {
+		key := rule.Name + "$$" + subject
+		alert, hasAlert := manager.alerts[key]
+		observation, observed := observations[subject]
+
+		if observed && observation.matched {
+			if !hasAlert || alert.State == ALERT_STATE_RESOLVED {
+				alert = &Alert{
+					Rule:      rule.Name,
+					Type:      rule.Type,
+					Subject:   subject,
+					State:     ALERT_STATE_PENDING,
+					Threshold: rule.Threshold,
+					PendingAt: now.Unix(),
+				}
+				manager.alerts[key] = alert
+			}
+			alert.Value = observation.value
+			alert.Message = observation.message
+
+			switch alert.State {
+			case ALERT_STATE_PENDING:
+				if now.Sub(time.Unix(alert.PendingAt, 0)) >= rule.forDuration {
+					alert.State = ALERT_STATE_FIRING
+					alert.FiredAt = now.Unix()
+					alert.NotifiedAt = now.Unix()
+					manager.notify(notify, *alert)
+				}
+			case ALERT_STATE_FIRING:
+				if rule.repeat > 0 && now.Sub(time.Unix(alert.NotifiedAt, 0)) >= rule.repeat {
+					alert.NotifiedAt = now.Unix()
+					manager.notify(notify, *alert)
+				}
+			}
+			continue
+		}
+
+		if !hasAlert {
+			continue
+		}
+
+		switch alert.State {
+		case ALERT_STATE_PENDING:
+			delete(manager.alerts, key)
+		case ALERT_STATE_FIRING:
+			alert.State = ALERT_STATE_RESOLVED
+			alert.ResolvedAt = now.Unix()
+			alert.NotifiedAt = now.Unix()
+			if observed {
+				alert.Value = observation.value
+				alert.Message = observation.message
+			} else {
+				alert.Message = "no enough requests to check '" + subject + "'"
+			}
+			manager.notify(notify, *alert)
+		case ALERT_STATE_RESOLVED:
+			if now.Sub(time.Unix(alert.ResolvedAt, 0)) >= ALERT_RESOLVED_KEEP {
+				delete(manager.alerts, key)
+			}
+		}
+	}
+}
+
+// 发送告警通知，命令可以从环境变量中读取告警信息，URL会收到JSON格式的告警信息
+func (manager *AlertManager) notify(notify plugins.NotifyConfig, alert Alert) {
+	log.Println("alert " + alert.State + ":" + alert.Rule + ":" + alert.Message)
+
+	if notify.IsEmpty() {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return
+	}
+
+	notify.Notify("Alert", plugins.NotifyMessage{
+		Env: []string{
+			"MELOY_ALERT_RULE=" + alert.Rule,
+			"MELOY_ALERT_TYPE=" + alert.Type,
+			"MELOY_ALERT_SUBJECT=" + alert.Subject,
+			"MELOY_ALERT_STATE=" + alert.State,
+			"MELOY_ALERT_VALUE=" + strconv.FormatFloat(alert.Value, 'f', -1, 64),
+			"MELOY_ALERT_THRESHOLD=" + strconv.FormatFloat(alert.Threshold, 'f', -1, 64),
+			"MELOY_ALERT_MESSAGE=" + alert.Message,
+		},
+		Body: body,
+	})
+}
+
+// 取得所有的规则
+func (manager *AlertManager) rules() []AlertRuleConfig {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return append([]AlertRuleConfig{}, manager.config.Rules...)
+}
+
+// 取得当前的告警，按照规则和对象排序
+func (manager *AlertManager) list() []Alert {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	alerts := []Alert{}
+	for _, alert := range manager.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule == alerts[j].Rule {
+			return alerts[i].Subject < alerts[j].Subject
+		}
+		return alerts[i].Rule < alerts[j].Rule
+	})
+	return alerts
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"log"
+	"net/http"
 	"reflect"
 	"regexp"
 	"strings"
@@ -35,6 +36,22 @@ type Api struct {
 	Timeout string `json:"timeout"`
 	MaxSize string `json:"maxSize"`
 
+	ConcurrencyConfig
+
+	Cache ApiCacheConfig `json:"cache"`
+
+	// 压缩
+	Compression ApiCompressionConfig `json:"compression"`
+
+	ClientCert ApiClientCert `json:"clientCert"`
+
+	Allow ClientListConfig `json:"allow"`
+	Deny  ClientListConfig `json:"deny"`
+
+	Limits struct {
+		Rates []RateLimitConfig `json:"rates"`
+	} `json:"limits"`
+
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Params      []struct {
@@ -67,6 +84,23 @@ type Api struct {
 	hasResponseString bool
 	timeoutDuration   time.Duration
 	maxSizeBits       float64
+
+	hasClientCertRules bool
+	clientFilter       *ClientFilter
+	rateLimiters       []*RateLimiter
+	concurrencyLimiter *ConcurrencyLimiter
+
+	cacheKeyTemplate *cacheKeyTemplate
+	cacheMethods     []string
+	cacheLifeMs      int64
+	cacheMaxSize     int64
+	cacheStatuses    []int
+
+	cacheStaleWhileRevalidateMs int64
+	cacheStaleIfErrorMs         int64
+	cacheCoalesceTimeout        time.Duration
+
+	compressor *Compressor
 }
 
 // 分析API
@@ -162,6 +196,65 @@ func (api *Api) parse() {
 		}
 	}
 
+	// 客户端证书
+	api.hasClientCertRules = len(api.ClientCert.Subjects) > 0 || len(api.ClientCert.SANs) > 0
+
+	// 客户端限制
+	api.clientFilter, err = newClientFilter(api.Allow, api.Deny)
+	if err != nil {
+		log.Println("Error:" + err.Error() + ", all clients of '" + api.Path + "' will be denied")
+	}
+
+	// 限流
+	api.rateLimiters = rateLimitManager.find(api.Path, api.Limits.Rates)
+
+	// 并发限制
+	api.concurrencyLimiter = concurrencyManager.find("api:"+api.Path, api.ConcurrencyConfig)
+
+	// 缓存
+	api.cacheKeyTemplate, err = parseCacheKeyTemplate(api.Cache.Key)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		api.cacheKeyTemplate, _ = parseCacheKeyTemplate("")
+	}
+	api.cacheMethods = []string{"GET", "HEAD"}
+	for _, method := range api.Cache.Methods {
+		method = strings.ToUpper(method)
+		if !containsString(api.cacheMethods, method) {
+			api.cacheMethods = append(api.cacheMethods, method)
+		}
+	}
+
+	api.cacheLifeMs = parseCachePeriodMs(api.Cache.TTL)
+	api.cacheStaleWhileRevalidateMs = parseCachePeriodMs(api.Cache.StaleWhileRevalidate)
+	api.cacheStaleIfErrorMs = parseCachePeriodMs(api.Cache.StaleIfError)
+
+	api.cacheCoalesceTimeout = time.Duration(parseCachePeriodMs(api.Cache.CoalesceTimeout)) * time.Millisecond
+	if api.cacheCoalesceTimeout <= 0 {
+		api.cacheCoalesceTimeout = api.timeoutDuration
+	}
+	if api.cacheCoalesceTimeout <= 0 {
+		api.cacheCoalesceTimeout = 30 * time.Second
+	}
+
+	api.cacheMaxSize = 0
+	if len(api.Cache.MaxSize) > 0 {
+		size, err := parseSizeFromString(api.Cache.MaxSize)
+		if err != nil {
+			log.Println("Parse "+api.Cache.MaxSize+" Error:", err.Error())
+		} else {
+			api.cacheMaxSize = int64(size)
+		}
+	}
+
+	api.cacheStatuses = api.Cache.Statuses
+	if len(api.cacheStatuses) == 0 {
+		api.cacheStatuses = []int{http.StatusOK}
+	}
+
+	// 压缩
+	api.compressor = newCompressor(api.Compression)
+
 	//地址信息
 	api.countAddresses = len(api.Addresses)
 }
@@ -195,4 +288,19 @@ func (api *Api) copyFrom(from Api) {
 	api.hasResponseString = from.hasResponseString
 	api.timeoutDuration = from.timeoutDuration
 	api.maxSizeBits = from.maxSizeBits
+
+	api.hasClientCertRules = from.hasClientCertRules
+	api.clientFilter = from.clientFilter
+	api.rateLimiters = from.rateLimiters
+	api.concurrencyLimiter = from.concurrencyLimiter
+
+	api.cacheKeyTemplate = from.cacheKeyTemplate
+	api.cacheMethods = from.cacheMethods
+	api.cacheLifeMs = from.cacheLifeMs
+	api.cacheMaxSize = from.cacheMaxSize
+	api.cacheStatuses = from.cacheStatuses
+	api.cacheStaleWhileRevalidateMs = from.cacheStaleWhileRevalidateMs
+	api.cacheStaleIfErrorMs = from.cacheStaleIfErrorMs
+	api.cacheCoalesceTimeout = from.cacheCoalesceTimeout
+	api.compressor = from.compressor
 }
@@ -2,12 +2,15 @@ package MeloyApi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/signal"
@@ -39,6 +42,8 @@ type Server struct {
 		Timeout string
 		MaxSize string
 
+		ConcurrencyConfig
+
 		timeoutDuration time.Duration
 		maxSizeBits     float64
 	}
@@ -51,23 +56,39 @@ type AppConfig struct {
 	SSL struct {
 		Cert string
 		Key  string
-	}
 
-	Allow struct {
-		Clients []string
+		ClientCA     string // 客户端证书的CA文件
+		ClientAuth   string // 客户端证书校验方式：none, request, require
+		ClientHeader string // 转发客户端证书身份的头部，默认为Meloy-Client-Cert
 	}
 
-	Deny struct {
-		Clients []string
-	}
+	Allow ClientListConfig
+	Deny  ClientListConfig
 
 	Limits struct {
 		Requests struct {
 			Minute int
 			Day    int
 		}
+
+		Rates []RateLimitConfig
 	}
 
+	// 缓存
+	Cache CacheConfig
+
+	// 统计数据保留
+	Stat StatConfig
+
+	// 访问日志
+	AccessLog AccessLogConfig
+
+	// 链路追踪
+	Tracing TracingConfig
+
+	// 客户端排行
+	Talkers TalkerConfig
+
 	Users []struct {
 		Type     string
 		Username string
@@ -77,26 +98,21 @@ type AppConfig struct {
 	// 插件
 	Plugins []string
 
-	// 是否有限制
-	hasAllow bool
-	hasDeny  bool
+	// 客户端过滤
+	clientFilter *ClientFilter
 
 	// 监听
 	isWatching bool
 	watchingAt int64
 
 	// 限流
-	hasMinuteLimit bool
-	hasDayLimit    bool
-
-	limitLastMinute string
-	limitLastDay    string
-
-	limitMinuteLeft int
-	limitDayLeft    int
+	rateLimiters []*RateLimiter
 
 	// 用户限制
 	hasUsers bool
+
+	// 客户端证书
+	clientHeader string
 }
 
 // API配置
@@ -174,8 +190,17 @@ func Start(appDir string) {
 			if sig == syscall.SIGHUP {
 				appManager.reload()
 			} else if sig == syscall.SIGTERM {
+				rateLimitManager.dump()
+				cacheManager.dump()
+				accessLogManager.flush()
+				tracingManager.flush()
 				pluginManager.Stop()
 			} else {
+				rateLimitManager.dump()
+				cacheManager.dump()
+				accessLogManager.flush()
+				tracingManager.flush()
+
 				pidFile := appManager.AppDir + "/data/pid"
 				exist, _ := FileExists(pidFile)
 				if exist {
@@ -187,11 +212,14 @@ func Start(appDir string) {
 		}
 	}()
 
+	// 加载应用配置，统计数据的存储方式在配置中指定
+	appManager.loadAppConfig()
+
 	// 初始化统计管理器
 	statManager.init(appDir)
 
-	// 加载应用配置
-	appManager.loadAppConfig()
+	// 初始化限流管理器
+	rateLimitManager.init()
 
 	address := fmt.Sprintf("%s:%d", appConfig.Host, appConfig.Port)
 	log.Printf("start %s:%d\n", appConfig.Host, appConfig.Port)
@@ -199,6 +227,9 @@ func Start(appDir string) {
 	// 初始化Handler管理器
 	handlerManager.init()
 
+	// 启动缓存
+	cacheManager.init()
+
 	// 加载数据
 	appManager.reload()
 
@@ -206,9 +237,16 @@ func Start(appDir string) {
 	go func() {
 		err = nil
 		if len(appConfig.SSL.Key) == 0 || len(appConfig.SSL.Cert) == 0 {
-			err = http.ListenAndServe(address, serverMux)
+			err = http.ListenAndServe(address, tracingManager.wrap(serverMux))
 		} else {
-			err = http.ListenAndServeTLS(address, appConfig.SSL.Cert, appConfig.SSL.Key, serverMux)
+			server := &http.Server{
+				Addr:    address,
+				Handler: tracingManager.wrap(serverMux),
+			}
+			server.TLSConfig, err = appManager.buildTLSConfig()
+			if err == nil {
+				err = server.ListenAndServeTLS(appConfig.SSL.Cert, appConfig.SSL.Key)
+			}
 		}
 
 		// 处理错误
@@ -225,9 +263,6 @@ func Start(appDir string) {
 	// 启动Admin
 	adminManager.Load(appDir)
 
-	// 启动缓存
-	cacheManager.init()
-
 	// 启动插件
 	pluginManager.Init()
 	pluginManager.Start(appDir)
@@ -469,15 +504,38 @@ func (manager *AppManager) loadAppConfig() {
 	// 用户限制
 	appConfig.hasUsers = len(appConfig.Users) > 0
 
+	// 客户端证书
+	appConfig.clientHeader = appConfig.SSL.ClientHeader
+	if len(appConfig.clientHeader) == 0 {
+		appConfig.clientHeader = CLIENT_CERT_DEFAULT_HEADER
+	}
+
 	// 客户端限制
-	appConfig.hasAllow = len(appConfig.Allow.Clients) > 0
-	appConfig.hasDeny = len(appConfig.Deny.Clients) > 0
+	appConfig.clientFilter, err = newClientFilter(appConfig.Allow, appConfig.Deny)
+	if err != nil {
+		log.Printf("Error:%s, all clients will be denied\n", err)
+	}
 
 	// 请求限制
-	appConfig.limitDayLeft = appConfig.Limits.Requests.Day
-	appConfig.limitMinuteLeft = appConfig.Limits.Requests.Minute
-	appConfig.hasDayLimit = appConfig.limitDayLeft > 0
-	appConfig.hasMinuteLimit = appConfig.limitMinuteLeft > 0
+	rates := []RateLimitConfig{}
+	if appConfig.Limits.Requests.Minute > 0 {
+		rates = append(rates, RateLimitConfig{
+			Algorithm: RATE_LIMIT_SLIDING_WINDOW,
+			Key:       "global",
+			Requests:  appConfig.Limits.Requests.Minute,
+			Period:    "1m",
+		})
+	}
+	if appConfig.Limits.Requests.Day > 0 {
+		rates = append(rates, RateLimitConfig{
+			Algorithm: RATE_LIMIT_QUOTA,
+			Key:       "global",
+			Requests:  appConfig.Limits.Requests.Day,
+			Period:    "day",
+		})
+	}
+	rates = append(rates, appConfig.Limits.Rates...)
+	appConfig.rateLimiters = rateLimitManager.find("", rates)
 }
 
 // 重新加载API配置
@@ -485,11 +543,34 @@ func (manager *AppManager) reload() {
 	// 应用配置
 	manager.loadAppConfig()
 
+	// 缓存配置
+	cacheManager.reloadConfig()
+
+	// 访问日志
+	accessLogManager.reload()
+
+	// 链路追踪
+	tracingManager.reload()
+
+	// 客户端排行
+	talkerManager.reload()
+
+	// 告警规则
+	alertManager.load(manager.AppDir)
+
 	// 服务器配置
 	servers := appManager.loadServers()
+	concurrencyManager.reloadServers(servers)
 	ApiArray = []Api{}
 	appManager.loadApis(manager.AppDir+string(os.PathSeparator)+"apis", servers, &ApiArray)
 
+	// 删除不再使用的限流器
+	rateLimiters := append([]*RateLimiter{}, appConfig.rateLimiters...)
+	for _, api := range ApiArray {
+		rateLimiters = append(rateLimiters, api.rateLimiters...)
+	}
+	rateLimitManager.retain(rateLimiters)
+
 	handlerManager.disableAll()
 
 	//处理pattern
@@ -761,21 +842,63 @@ func (manager *AppManager) loadApis(apiDir string, servers []Server, apis *[]Api
 
 // 处理请求
 func (manager *AppManager) handle(writer http.ResponseWriter, request *http.Request, api *Api) {
+	// 记录监控指标
+	startedAt := time.Now()
+	statusWriter := newStatusWriter(writer)
+	writer = statusWriter
+
+	// 访问日志
+	var accessLog *AccessLogEntry
+	accessLog, request = accessLogManager.begin(request, api.Path)
+	writer.Header().Set(ACCESS_LOG_REQUEST_ID_HEADER, request.Header.Get(ACCESS_LOG_REQUEST_ID_HEADER))
+
+	// 链路追踪
+	finishTraceRoute(request, api.Path)
+	traceSpan := findTraceSpan(request)
+	traceSpan.setAttribute("meloy.request_id", request.Header.Get(ACCESS_LOG_REQUEST_ID_HEADER))
+
+	// 客户端排行，在各种校验之前记录，以便找出被拒绝的客户端
+	consumer := manager.findConsumer(request)
+	talkerManager.send(api.Path, request, consumer)
+
+	var address ApiAddress
+
+	// 统计网关拒绝的请求，状态码记为负数，不计入API服务器的状态码分类和错误数，服务器和主机为空
+	sendRejectedStat := func(statusCode int) {
+		statManager.send(ApiAddress{}, api.Path, consumer, request.RequestURI, time.Since(startedAt).Nanoseconds()/1000000, -statusCode, 0, 0)
+	}
+
+	defer func() {
+		metricsManager.observe(api.Path, address.Server, address.Host, strings.ToUpper(request.Method), statusWriter.status(), time.Since(startedAt))
+
+		accessLog.finish(statusWriter.status(), statusWriter.Bytes)
+		accessLogManager.write(accessLog)
+	}()
+
 	// 登录用户
 	if !manager.validateUser(request) {
 		http.Error(writer, "Permission Denied", http.StatusForbidden)
+		sendRejectedStat(http.StatusForbidden)
 		return
 	}
 
 	// 校验请求
-	if !manager.validateRequest(request) {
+	if !manager.validateRequest(request, api) {
+		http.Error(writer, "Permission Denied", http.StatusForbidden)
+		sendRejectedStat(http.StatusForbidden)
+		return
+	}
+
+	// 校验客户端证书
+	if !manager.validateClientCert(request, api) {
 		http.Error(writer, "Permission Denied", http.StatusForbidden)
+		sendRejectedStat(http.StatusForbidden)
 		return
 	}
 
 	// 处理限流
-	if manager.reachLimit() {
-		http.Error(writer, "API requests limit reached", http.StatusForbidden)
+	if !rateLimitManager.check(writer, request, api) {
+		sendRejectedStat(http.StatusTooManyRequests)
 		return
 	}
 
@@ -785,7 +908,6 @@ func (manager *AppManager) handle(writer http.ResponseWriter, request *http.Requ
 	}
 
 	// 选取地址
-	var address ApiAddress
 	if api.countAddresses > 1 {
 		rand.Seed(time.Now().UnixNano())
 		index := rand.Int() % api.countAddresses
@@ -801,16 +923,47 @@ func (manager *AppManager) handle(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
+	// 并发限制
+	release, ok := concurrencyManager.acquire(api, address.Server)
+	if !ok {
+		http.Error(writer, "Service Unavailable", http.StatusServiceUnavailable)
+		sendRejectedStat(http.StatusServiceUnavailable)
+
+		// 没有转发到API服务器，监控指标中也不计入服务器
+		address = ApiAddress{}
+		return
+	}
+	accessLog.setUpstream(address)
+	traceSpan.setAttribute("meloy.server", address.Server)
+
+	isReleasedLater := false
 	hookManager.beforeHook(writer, request, api, func(hookContext *HookContext) {
 		if api.IsAsynchronous {
 			manager.setApiHeaders(writer, api)
 			writer.Write([]byte(api.responseString))
-			go manager.handleMethod(writer, request, api, address, method, hookContext)
+
+			isReleasedLater = true
+			go func() {
+				defer release()
+				manager.handleMethod(writer, request, api, address, method, hookContext)
+			}()
 		} else {
 			// 开始处理
 			manager.handleMethod(writer, request, api, address, method, hookContext)
 		}
 	})
+
+	if !isReleasedLater {
+		release()
+	}
+}
+
+// 发送统计信息，后台刷新缓存的请求不是客户端发起的，不计入统计
+func (manager *AppManager) sendStat(request *http.Request, address ApiAddress, path string, consumer string, uri string, timeMs int64, statusCode int, errors int64, hits int64) {
+	if isCacheRevalidating(request) {
+		return
+	}
+	statManager.send(address, path, consumer, uri, timeMs, statusCode, errors, hits)
 }
 
 // 转发某个方法的请求
@@ -818,6 +971,8 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 	t := time.Now().UnixNano()
 
 	query := request.URL.RawQuery
+	consumer := manager.findConsumer(request)
+	accessLog := findAccessLogEntry(request)
 
 	// 判断最大内容长度
 	if api.maxSizeBits > 0 && float64(request.ContentLength) > api.maxSizeBits {
@@ -827,21 +982,66 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 	}
 
 	// 是否有缓存
-	cacheKey := request.URL.RequestURI()
-	cacheEntry, ok := cacheManager.get(cacheKey)
-	if ok {
-		for key, values := range cacheEntry.Header {
-			for _, value := range values {
-				writer.Header().Add(key, value)
-			}
+	cacheKey := api.cacheKeyTemplate.build(request, consumer)
+	isCacheable := containsString(api.cacheMethods, method) && api.cacheKeyTemplate.allows(request)
+	var staleEntry *CacheEntry
+	if isCacheable {
+		cacheSpan := findTraceSpan(request).child("cache.lookup", TRACE_SPAN_KIND_INTERNAL)
+		cacheEntry, ok := cacheManager.get(cacheKey, request)
+		cacheSpan.setAttribute("meloy.cache.found", ok)
+		if ok {
+			cacheSpan.setAttribute("meloy.cache.stale", cacheEntry.isStale())
 		}
+		cacheSpan.end()
 
-		manager.setApiHeaders(writer, api)
-		writer.Write(cacheEntry.Bytes)
+		if ok && !isCacheRevalidating(request) {
+			if !cacheEntry.isStale() {
+				accessLog.setCacheStatus(ACCESS_LOG_CACHE_HIT)
+				manager.writeCacheEntry(writer, request, api, cacheEntry)
+				manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, cacheEntry.responseStatus(), 0, 1)
+				return
+			}
+
+			// 过期不久的先返回旧内容，同时在后台刷新
+			if cacheEntry.isStaleWithin(api.cacheStaleWhileRevalidateMs) {
+				accessLog.setCacheStatus(ACCESS_LOG_CACHE_STALE)
+				manager.writeCacheEntry(writer, request, api, cacheEntry)
+				manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, cacheEntry.responseStatus(), 0, 1)
+				manager.revalidate(request, api, address, method, cacheKey)
+				return
+			}
+		}
+		if ok {
+			staleEntry = cacheEntry
+		}
+		accessLog.setCacheStatus(ACCESS_LOG_CACHE_MISS)
+	} else {
+		accessLog.setCacheStatus(ACCESS_LOG_CACHE_BYPASS)
+	}
 
-		statManager.send(address, api.Path, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 0, 1)
+	// 合并相同缓存键的请求
+	var flight *CacheFlight
+	if isCacheable && api.Cache.Coalesce && !isCacheRevalidating(request) {
+		var isLeader bool
+		flight, isLeader = cacheManager.joinFlight(cacheKey)
+		if isLeader {
+			defer cacheManager.finishFlight(cacheKey, flight)
+		} else {
+			sharedEntry, ok := flight.wait(api.cacheCoalesceTimeout)
+			if ok {
+				accessLog.setCacheStatus(ACCESS_LOG_CACHE_HIT)
+				manager.writeCacheEntry(writer, request, api, sharedEntry)
 
-		return
+				// 共享的服务器错误计入错误数，不算作命中
+				var errors, hits int64 = 0, 1
+				if sharedEntry.responseStatus() >= http.StatusInternalServerError {
+					errors, hits = 1, 0
+				}
+				manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, sharedEntry.responseStatus(), errors, hits)
+				return
+			}
+			flight = nil
+		}
 	}
 
 	requestURL := address.URL
@@ -858,12 +1058,18 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 		manager.setApiHeaders(writer, api)
 
 		hookManager.afterHook(hookContext, nil, err)
-		statManager.send(address, api.Path, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 1, 0)
+		manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 0, 1, 0)
 		return
 	}
 
 	newRequest.Header = request.Header
 	request.Header.Set("Meloy-Api", "1.0")
+
+	// 转发客户端证书身份，同时避免客户端伪造
+	request.Header.Del(appConfig.clientHeader)
+	if identity := manager.findClientCertIdentity(request); len(identity) > 0 {
+		request.Header.Set(appConfig.clientHeader, identity)
+	}
 	newRequest.Body = request.Body
 
 	// 超时时间
@@ -910,16 +1116,57 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 
 	}
 
+	// 使用过期缓存的验证信息向API服务器发起条件请求
+	isConditional := false
+	if staleEntry != nil && staleEntry.isRevalidatable() {
+		header := http.Header{}
+		for key, values := range newRequest.Header {
+			header[key] = values
+		}
+		staleEntry.addConditionalHeaders(header)
+		newRequest.Header = header
+		isConditional = true
+	}
+
+	// 向API服务器传递链路信息
+	upstreamSpan := findTraceSpan(request).child("upstream", TRACE_SPAN_KIND_CLIENT)
+	if upstreamSpan != nil {
+		header := http.Header{}
+		for key, values := range newRequest.Header {
+			header[key] = values
+		}
+		header.Set(TRACEPARENT_HEADER, upstreamSpan.traceparent())
+		newRequest.Header = header
+
+		upstreamSpan.setAttribute("http.method", method)
+		upstreamSpan.setAttribute("http.url", requestURL)
+		upstreamSpan.setAttribute("net.peer.name", address.Host)
+		upstreamSpan.setAttribute("meloy.server", address.Server)
+		defer upstreamSpan.end()
+	}
+
+	upstreamStartedAt := time.Now()
 	resp, err := requestClient.Do(newRequest)
 
 	if err != nil {
-		manager.setApiHeaders(writer, api)
-
+		upstreamSpan.setStatus(TRACE_STATUS_ERROR, err.Error())
+		upstreamSpan.end()
+		accessLog.setUpstreamDuration(time.Since(upstreamStartedAt))
 		log.Println("Error:" + err.Error())
 		hookManager.afterHook(hookContext, nil, err)
 
+		// 出错时返回旧内容
+		if staleEntry != nil && staleEntry.isStaleWithin(api.cacheStaleIfErrorMs) {
+			accessLog.setCacheStatus(ACCESS_LOG_CACHE_STALE)
+			manager.writeCacheEntry(writer, request, api, staleEntry)
+			manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 0, 1, 1)
+			return
+		}
+
+		manager.setApiHeaders(writer, api)
+
 		// 统计
-		statManager.send(address, api.Path, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 1, 0)
+		manager.sendStat(request, address, api.Path, consumer, request.RequestURI, (time.Now().UnixNano()-t)/1000000, 0, 1, 0)
 		return
 	}
 
@@ -933,9 +1180,33 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 	// 调用钩子
 	hookManager.afterHook(hookContext, resp, nil)
 
+	// 服务器错误时返回旧内容
+	if resp.StatusCode >= http.StatusInternalServerError && staleEntry != nil && staleEntry.isStaleWithin(api.cacheStaleIfErrorMs) {
+		resp.Body.Close()
+		upstreamSpan.setAttribute("http.status_code", resp.StatusCode)
+		upstreamSpan.setStatus(TRACE_STATUS_ERROR, resp.Status)
+		upstreamSpan.end()
+		accessLog.setUpstreamDuration(time.Since(upstreamStartedAt))
+		log.Println("Error: api return ", resp.Status)
+
+		accessLog.setCacheStatus(ACCESS_LOG_CACHE_STALE)
+		manager.writeCacheEntry(writer, request, api, staleEntry)
+		manager.sendStat(request, address, api.Path, consumer, uri, (time.Now().UnixNano()-t)/1000000, resp.StatusCode, 1, 1)
+		return
+	}
+
 	// 分析头部指令等信息
 	apiConfig := ApiConfig{
-		cacheTags: []string{"$MeloyAPI$" + api.Path},
+		cacheTags:   append([]string{"$MeloyAPI$" + api.Path}, api.Cache.Tags...),
+		cacheLifeMs: api.cacheLifeMs,
+	}
+	if api.Cache.RespectCacheControl {
+		lifeMs, hasLife, ok := parseCacheControl(resp.Header)
+		if !ok {
+			apiConfig.cacheLifeMs = 0
+		} else if hasLife {
+			apiConfig.cacheLifeMs = lifeMs
+		}
 	}
 	manager.parseResponseHeaders(writer, request, resp, address, api, &apiConfig)
 	manager.setApiHeaders(writer, api)
@@ -949,30 +1220,151 @@ func (manager *AppManager) handleMethod(writer http.ResponseWriter, request *htt
 	}
 
 	resp.Body.Close()
+	upstreamSpan.setAttribute("http.status_code", resp.StatusCode)
+	if err != nil {
+		upstreamSpan.setStatus(TRACE_STATUS_ERROR, err.Error())
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		upstreamSpan.setStatus(TRACE_STATUS_ERROR, resp.Status)
+	}
+	upstreamSpan.end()
+	accessLog.setUpstreamDuration(time.Since(upstreamStartedAt))
 
 	if err != nil {
 		log.Println("Error:" + err.Error())
-		statManager.send(address, api.Path, uri, (time.Now().UnixNano()-t)/1000000, 1, 0)
+		manager.sendStat(request, address, api.Path, consumer, uri, (time.Now().UnixNano()-t)/1000000, 0, 1, 0)
 		return
 	}
 
+	// API服务器确认过期的缓存没有变化，继续使用缓存的内容
+	statusCode := resp.StatusCode
+	if isConditional && statusCode == http.StatusNotModified {
+		accessLog.setCacheStatus(ACCESS_LOG_CACHE_REVALIDATED)
+		for key, values := range staleEntry.Header {
+			if _, ok := writer.Header()[key]; !ok {
+				writer.Header()[key] = append([]string{}, values...)
+			}
+		}
+		statusCode = staleEntry.StatusCode
+		_bytes = staleEntry.Bytes
+	}
+
 	// 缓存
-	if apiConfig.cacheLifeMs > 0 {
-		cacheManager.set(cacheKey, apiConfig.cacheTags, _bytes, writer.Header(), apiConfig.cacheLifeMs)
+	var variants map[string][]byte
+	if isCacheable && apiConfig.cacheLifeMs > 0 && containsInt(api.cacheStatuses, statusCode) && (api.cacheMaxSize <= 0 || int64(len(_bytes)) <= api.cacheMaxSize) {
+		staleMs := api.cacheStaleWhileRevalidateMs
+		if api.cacheStaleIfErrorMs > staleMs {
+			staleMs = api.cacheStaleIfErrorMs
+		}
+		variants = api.compressor.compressAll(writer.Header(), statusCode, _bytes)
+		entry := cacheManager.set(cacheKey, request, apiConfig.cacheTags, statusCode, _bytes, variants, writer.Header(), apiConfig.cacheLifeMs, staleMs)
+		if entry != nil {
+			writer.Header().Set("ETag", entry.ETag)
+			writer.Header().Set("Last-Modified", entry.LastModified)
+		}
+	}
+
+	// 共享给等待的请求
+	if flight != nil {
+		flight.share(statusCode, _bytes, writer.Header(), api.cacheStatuses)
 	}
 
 	// 如果不是异步请求的，就返回请求得到的数据
 	if !api.IsAsynchronous {
-		writer.Write(_bytes)
+		manager.writeResponse(writer, request, api, statusCode, _bytes, variants)
 	}
 
+	// 只有服务器错误才计入错误数，其他状态码按分类统计
 	var errors int64 = 0
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	if statusCode >= http.StatusInternalServerError {
 		errors++
 		log.Println("Error: api return ", resp.Status)
 	}
 
-	statManager.send(address, api.Path, uri, (time.Now().UnixNano()-t)/1000000, errors, 0)
+	manager.sendStat(request, address, api.Path, consumer, uri, (time.Now().UnixNano()-t)/1000000, statusCode, errors, 0)
+}
+
+// 输出缓存的内容，缓存的头部替换已经设置的同名头部，请求ID保留当前请求的
+func (manager *AppManager) writeCacheEntry(writer http.ResponseWriter, request *http.Request, api *Api, entry *CacheEntry) {
+	for key, values := range entry.Header {
+		if key == ACCESS_LOG_REQUEST_ID_HEADER {
+			continue
+		}
+		writer.Header()[key] = append([]string{}, values...)
+	}
+
+	manager.setApiHeaders(writer, api)
+
+	manager.writeResponse(writer, request, api, entry.responseStatus(), entry.Bytes, entry.Variants)
+}
+
+// 输出响应内容，如果客户端缓存的内容仍然有效则返回304
+// variants中为已经压缩好的内容，没有时根据需要压缩
+func (manager *AppManager) writeResponse(writer http.ResponseWriter, request *http.Request, api *Api, statusCode int, _bytes []byte, variants map[string][]byte) {
+	// 压缩
+	if api.compressor.isCompressible(writer.Header(), statusCode, len(_bytes)) {
+		addVaryAcceptEncoding(writer.Header())
+
+		encoding := api.compressor.negotiate(request)
+		if len(encoding) > 0 {
+			compressed, ok := variants[encoding]
+			if !ok {
+				var err error
+				compressed, err = compressBytes(encoding, _bytes)
+				if err != nil {
+					log.Println("Error:" + err.Error())
+				} else {
+					ok = true
+				}
+			}
+
+			if ok {
+				writer.Header().Set("Content-Encoding", encoding)
+				writer.Header().Del("Content-Length")
+				if etag := writer.Header().Get("ETag"); len(etag) > 0 {
+					writer.Header().Set("ETag", compressedETag(etag, encoding))
+				}
+				_bytes = compressed
+			}
+		}
+	}
+
+	if statusCode == http.StatusOK && isNotModified(request, writer.Header()) {
+		writer.Header().Del("Content-Type")
+		writer.Header().Del("Content-Length")
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writer.WriteHeader(statusCode)
+	writer.Write(_bytes)
+}
+
+// 在后台刷新缓存，同一个键同时只有一个刷新请求
+func (manager *AppManager) revalidate(request *http.Request, api *Api, address ApiAddress, method string, cacheKey string) {
+	if !cacheManager.startRevalidate(cacheKey) {
+		return
+	}
+
+	// 复制请求，原请求在返回后不能再使用
+	header := http.Header{}
+	for key, values := range request.Header {
+		header[key] = append([]string{}, values...)
+	}
+	newRequest := request.WithContext(context.WithValue(context.Background(), cacheRevalidateContextKey, true))
+	newRequest.Header = header
+	newRequest.Body = http.NoBody
+	newRequest.ContentLength = 0
+
+	go func() {
+		defer cacheManager.finishRevalidate(cacheKey)
+
+		writer := httptest.NewRecorder()
+		manager.handleMethod(writer, newRequest, api, address, method, &HookContext{
+			Writer:  writer,
+			Request: newRequest,
+			Api:     api,
+		})
+	}()
 }
 
 // 分析响应头部
@@ -1145,72 +1537,35 @@ func (manager *AppManager) validateUser(request *http.Request) bool {
 	return false
 }
 
-// 校验请求
-func (manager *AppManager) validateRequest(request *http.Request) bool {
-	if !appConfig.hasAllow && !appConfig.hasDeny {
-		return true
-	}
-
-	reg, _ := ReuseRegexpCompile(":\\d+$")
-	ip := reg.ReplaceAllString(request.RemoteAddr, "")
-
-	// 本地的
-	if appConfig.Host == "0.0.0.0" && ip == "[::1]" {
-		return true
+// 取得请求的调用者
+// 优先使用客户端证书身份，其次是用户名
+func (manager *AppManager) findConsumer(request *http.Request) string {
+	if identity := manager.findClientCertIdentity(request); len(identity) > 0 {
+		return identity
 	}
 
-	// 禁止的
-	if appConfig.hasDeny {
-		if containsString(appConfig.Deny.Clients, ip) {
-			return false
-		}
+	if appConfig.hasUsers {
+		return request.Header.Get("Meloy-Username")
 	}
 
-	// 支持的
-	if appConfig.hasAllow {
-		if !containsString(appConfig.Allow.Clients, ip) {
-			return false
-		}
-	}
-
-	return true
+	return ""
 }
 
-// 判断是否达到请求限制
-func (manager *AppManager) reachLimit() bool {
-	if !appConfig.hasMinuteLimit && !appConfig.hasDayLimit {
-		return false
-	}
-
-	now := time.Now()
-
-	if appConfig.hasMinuteLimit {
-		currentMinute := fmt.Sprintf("%04d-%02d-%02d %02d:%02d", now.Year(), int(now.Month()), now.Day(), now.Hour(), now.Minute())
-		if currentMinute != appConfig.limitLastMinute {
-			appConfig.limitLastMinute = currentMinute
-			appConfig.limitMinuteLeft = appConfig.Limits.Requests.Minute
-		}
-
-		if appConfig.limitMinuteLeft <= 0 {
-			return true
-		}
-		appConfig.limitMinuteLeft--
+// 校验请求
+func (manager *AppManager) validateRequest(request *http.Request, api *Api) bool {
+	filter := appConfig.clientFilter.override(api.clientFilter)
+	if filter == nil {
+		return true
 	}
 
-	if appConfig.hasDayLimit {
-		currentDay := fmt.Sprintf("%04d-%02d-%02d", now.Year(), int(now.Month()), now.Day())
-		if currentDay != appConfig.limitLastDay {
-			appConfig.limitLastDay = currentDay
-			appConfig.limitDayLeft = appConfig.Limits.Requests.Day
-		}
+	ip := parseRemoteIP(request.RemoteAddr)
 
-		if appConfig.limitDayLeft <= 0 {
-			return true
-		}
-		appConfig.limitDayLeft--
+	// 本地的
+	if appConfig.Host == "0.0.0.0" && ip != nil && ip.Equal(net.IPv6loopback) {
+		return true
 	}
 
-	return false
+	return filter.allows(ip)
 }
 
 // 设置API头部信息
@@ -1,207 +1,562 @@
 package MeloyApi
 
 import (
+	"container/heap"
+	"container/list"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 缓存淘汰策略
+const (
+	CACHE_POLICY_LRU = "lru"
+	CACHE_POLICY_LFU = "lfu"
+)
+
+// 默认缓存最大尺寸
+const CACHE_DEFAULT_MAX_SIZE = 256 << 20
+
+// 每个缓存条目额外占用的估算字节数
+const CACHE_ENTRY_OVERHEAD = 128
+
+// 缓存配置
+type CacheConfig struct {
+	MaxSize string          // 最大尺寸，比如 256m, 1g
+	Policy  string          // 淘汰策略：lru（默认）或者lfu
+	Disk    CacheDiskConfig // 磁盘缓存
+}
+
+// 缓存分片数量
+const CACHE_SHARDS = 32
+
 // 缓存管理器
+// 条目按照键的哈希值分布在多个分片中，每个分片有独立的锁和淘汰顺序，所有分片共用MaxBytes
+// 超出尺寸时比较各个分片中最先淘汰的条目，淘汰其中最应该淘汰的
 type CacheManager struct {
-	MaxSize int
+	MaxBytes int64
+	Policy   string
+
+	bytes int64 // 所有分片占用的字节数，使用atomic读写
 
-	Values map[string]CacheEntry
-	Tags   map[string]map[string]string // tag [key] map[key] ""
+	shards [CACHE_SHARDS]*cacheShard
+	disk   *CacheDisk // 磁盘缓存，没有启用时为nil
+	mutex  sync.Mutex
 
-	Mutex sync.RWMutex
+	diskMutex sync.Mutex // 重新加载磁盘缓存配置时加锁，加载索引期间不占用mutex
+
+	revalidatingKeys map[string]bool         // 正在后台刷新的键
+	flights          map[string]*CacheFlight // 正在合并的请求
+}
+
+// 缓存分片
+type cacheShard struct {
+	values map[string]*CacheEntry
+	tags   map[string]map[string]bool // tag => { key => true }
+
+	bytes      int64
+	totalBytes *int64 // 所有分片占用的字节数，指向CacheManager.bytes
+	policy     cachePolicy
+
+	// 计数
+	hits      int64
+	misses    int64
+	sets      int64
+	evictions int64
+	expires   int64
+	stales    int64
+
+	mutex sync.Mutex
 }
 
 // 缓存条目
 type CacheEntry struct {
+	Key         string
+	StatusCode  int
 	Bytes       []byte
+	Variants    map[string][]byte // 压缩后的内容，encoding => bytes
 	Header      http.Header
 	LifeMs      int64
 	ExpiredAtMs int64
+	StaleMs     int64 // 过期后继续保留的时间，用于stale-while-revalidate和stale-if-error
 	Tags        []string
+	Size        int64
+	Vary        []string // 不为空时表示此条目只记录Vary头部，实际内容在各个变体中
+
+	// 验证信息，API服务器没有提供时由网关生成
+	ETag                    string
+	LastModified            string
+	IsETagGenerated         bool
+	IsLastModifiedGenerated bool
+
+	// 淘汰策略使用的数据
+	element    *list.Element
+	heapIndex  int
+	frequency  int64
+	accessedAt int64
+}
+
+// 缓存淘汰策略
+type cachePolicy interface {
+	add(entry *CacheEntry)
+	access(entry *CacheEntry)
+	remove(entry *CacheEntry)
+	victim() *CacheEntry
+	before(entry1 *CacheEntry, entry2 *CacheEntry) bool // entry1是否应该比entry2先淘汰，用来比较不同分片中的条目
 }
 
 var cacheInitOnce sync.Once
 
 //初始化
 func (manager *CacheManager) init() {
-	manager.MaxSize = 1024 * 1024 * 10
-
 	cacheInitOnce.Do(func() {
-		manager.Values = make(map[string]CacheEntry)
-		manager.Tags = make(map[string]map[string]string)
+		for index := range manager.shards {
+			manager.shards[index] = &cacheShard{
+				values:     map[string]*CacheEntry{},
+				tags:       map[string]map[string]bool{},
+				totalBytes: &manager.bytes,
+				policy:     newCachePolicy(CACHE_POLICY_LRU),
+			}
+		}
+		manager.Policy = CACHE_POLICY_LRU
+
+		//每一分钟清理一次过期的条目，并保存磁盘缓存索引
+		go func() {
+			tick := time.Tick(1 * time.Minute)
+			for {
+				<-tick
+
+				manager.clearExpired()
+				manager.dump()
+			}
+		}()
 	})
 
-	//每一分钟清理一次过期的条目
-	go func() {
-		tick := time.Tick(1 * time.Minute)
-		for {
-			<-tick
+	manager.reloadConfig()
+}
 
-			manager.clearExpired()
+// 重新加载配置
+func (manager *CacheManager) reloadConfig() {
+	if manager.shards[0] == nil {
+		return
+	}
+
+	var maxBytes int64 = CACHE_DEFAULT_MAX_SIZE
+	if len(appConfig.Cache.MaxSize) > 0 {
+		size, err := parseSizeFromString(appConfig.Cache.MaxSize)
+		if err != nil {
+			log.Println("Parse "+appConfig.Cache.MaxSize+" Error:", err.Error())
+		} else {
+			maxBytes = int64(size)
 		}
-	}()
+	}
+
+	policy := strings.ToLower(appConfig.Cache.Policy)
+	if policy != CACHE_POLICY_LFU {
+		policy = CACHE_POLICY_LRU
+	}
+
+	manager.mutex.Lock()
+	isPolicyChanged := manager.Policy != policy
+	manager.MaxBytes = maxBytes
+	manager.Policy = policy
+	manager.mutex.Unlock()
+
+	// 更换策略时重新建立淘汰顺序
+	if isPolicyChanged {
+		for _, shard := range manager.shards {
+			shard.mutex.Lock()
+			shard.policy = newCachePolicy(policy)
+			for _, entry := range shard.values {
+				shard.policy.add(entry)
+			}
+			shard.mutex.Unlock()
+		}
+	}
+
+	manager.evict(0)
+
+	manager.reloadDisk()
 }
 
-// 清除过期的条目
-func (manager *CacheManager) clearExpired() {
-	//清除过期条目
-	for key, value := range manager.Values {
-		if value.ExpiredAtMs < int64(time.Now().UnixNano()/1000000) {
-			manager.deleteValue(key)
+// 重新加载磁盘缓存配置，第一次启用时加载已有的条目
+// 加载索引可能需要读取所有的条目文件，在mutex之外进行，以免阻塞请求
+func (manager *CacheManager) reloadDisk() {
+	manager.diskMutex.Lock()
+	defer manager.diskMutex.Unlock()
+
+	var maxBytes int64 = 0
+	if len(appConfig.Cache.Disk.MaxSize) > 0 {
+		size, err := parseSizeFromString(appConfig.Cache.Disk.MaxSize)
+		if err != nil {
+			log.Println("Parse "+appConfig.Cache.Disk.MaxSize+" Error:", err.Error())
+		} else {
+			maxBytes = int64(size)
 		}
 	}
 
-	//数量是否超出最大范围，如果超出则截为一半的数量
-	mapSize := len(manager.Values)
-	if mapSize > manager.MaxSize {
-		newSize := mapSize / 2
+	manager.mutex.Lock()
+	disk := manager.disk
+	if maxBytes <= 0 {
+		manager.disk = nil
+		manager.mutex.Unlock()
 
-		if newSize > 0 {
-			for key := range manager.Values {
-				if newSize <= 0 {
-					break
-				}
+		if disk != nil {
+			disk.dump()
+		}
+		return
+	}
+	if disk != nil {
+		manager.mutex.Unlock()
+		disk.resize(maxBytes)
+		return
+	}
+
+	manager.mutex.Unlock()
+
+	disk = newCacheDisk(appManager.AppDir+"/"+CACHE_DISK_DIR, maxBytes)
+
+	manager.mutex.Lock()
+	manager.disk = disk
+	memoryBytes := manager.MaxBytes
+	manager.mutex.Unlock()
+
+	go func() {
+		count := disk.warmUp(memoryBytes, manager.setEntry)
+		if count > 0 {
+			log.Println("load " + strconv.Itoa(count) + " cache entries from disk")
+		}
+	}()
+}
+
+// 取得磁盘缓存
+func (manager *CacheManager) findDisk() *CacheDisk {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return manager.disk
+}
+
+// 保存磁盘缓存索引
+func (manager *CacheManager) dump() {
+	if disk := manager.findDisk(); disk != nil {
+		disk.dump()
+	}
+}
 
-				manager.deleteValue(key)
+// 取得键对应的分片
+func (manager *CacheManager) shard(key string) *cacheShard {
+	// FNV-1a
+	var hash uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return manager.shards[hash%CACHE_SHARDS]
+}
 
-				newSize --
+// 清除过期的条目
+func (manager *CacheManager) clearExpired() {
+	nowMs := time.Now().UnixNano() / 1000000
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+		for key, entry := range shard.values {
+			if entry.ExpiredAtMs+entry.StaleMs < nowMs {
+				shard.deleteValue(key)
+				shard.expires++
 			}
 		}
+		shard.mutex.Unlock()
+	}
+
+	if disk := manager.findDisk(); disk != nil {
+		disk.clearExpired()
 	}
 }
 
 // 清除所有的条目
 func (manager *CacheManager) clearAll() (count int) {
-	manager.Mutex.Lock()
-	defer manager.Mutex.Unlock()
+	manager.mutex.Lock()
+	policy := manager.Policy
+	manager.mutex.Unlock()
+
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+		count += len(shard.values)
+		shard.values = map[string]*CacheEntry{}
+		shard.tags = map[string]map[string]bool{}
+		atomic.AddInt64(shard.totalBytes, -shard.bytes)
+		shard.bytes = 0
+		shard.policy = newCachePolicy(policy)
+		shard.mutex.Unlock()
+	}
 
-	count = len(manager.Values)
-	manager.Values = make(map[string]CacheEntry)
-	manager.Tags = make(map[string]map[string]string)
+	if disk := manager.findDisk(); disk != nil {
+		disk.clearAll()
+	}
 	return
 }
 
 // 删除某个标签关联的条目
 func (manager *CacheManager) deleteTag(tag string) (count int) {
-	keyMap, ok := manager.Tags[tag]
-	if !ok {
-		return
-	}
-
-	if keyMap == nil {
-		manager.Mutex.Lock()
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
 
-		delete(manager.Tags, tag)
+		keyMap, ok := shard.tags[tag]
+		if ok {
+			delete(shard.tags, tag)
 
-		manager.Mutex.Unlock()
+			count += len(keyMap)
+			for key := range keyMap {
+				shard.deleteValue(key)
+			}
+		}
 
-		return
+		shard.mutex.Unlock()
 	}
 
-	count = len(keyMap)
-
-	manager.Mutex.Lock()
-	delete(manager.Tags, tag)
-	manager.Mutex.Unlock()
-
-	for key := range keyMap {
-		manager.deleteValue(key)
+	if disk := manager.findDisk(); disk != nil {
+		diskCount := disk.deleteTag(tag)
+		if diskCount > count {
+			count = diskCount
+		}
 	}
 
 	return
 }
 
-// 设置条目内容
-func (manager *CacheManager) set(key string, tags []string, _bytes []byte, header http.Header, lifeMs int64) {
-	nowMs := time.Now().UnixNano() / 1000000
+// 设置条目内容，返回写入的条目
+// 如果响应头部中有Vary，则按照请求中对应的头部分别缓存
+func (manager *CacheManager) set(key string, request *http.Request, tags []string, statusCode int, _bytes []byte, variants map[string][]byte, header http.Header, lifeMs int64, staleMs int64) *CacheEntry {
+	vary, ok := parseVaryHeader(header)
+	if !ok {
+		return nil
+	}
 
-	manager.Mutex.Lock()
-	defer manager.Mutex.Unlock()
+	nowMs := time.Now().UnixNano() / 1000000
 
 	if tags == nil {
 		tags = []string{}
 	}
 
-	manager.Values[key] = CacheEntry{
+	header = cloneCacheHeader(header)
+
+	// 验证信息
+	etag := header.Get("ETag")
+	isETagGenerated := false
+	if len(etag) == 0 {
+		etag = generateETag(_bytes)
+		header.Set("ETag", etag)
+		isETagGenerated = true
+	}
+
+	lastModified := header.Get("Last-Modified")
+	isLastModifiedGenerated := false
+	if len(lastModified) == 0 {
+		lastModified = time.Now().UTC().Format(http.TimeFormat)
+		header.Set("Last-Modified", lastModified)
+		isLastModifiedGenerated = true
+	}
+
+	// 有API服务器提供的验证信息时，过期后继续保留一段时间，以便发起条件请求
+	if (!isETagGenerated || !isLastModifiedGenerated) && staleMs < lifeMs {
+		staleMs = lifeMs
+	}
+
+	disk := manager.findDisk()
+
+	if len(vary) > 0 && request != nil {
+		marker := &CacheEntry{
+			Key:         key,
+			LifeMs:      lifeMs,
+			ExpiredAtMs: nowMs + lifeMs,
+			StaleMs:     staleMs,
+			Tags:        tags,
+			Size:        cacheEntrySize(key, nil, nil, nil),
+			Vary:        vary,
+		}
+		manager.setEntry(marker)
+		if disk != nil {
+			disk.put(marker)
+		}
+		key = buildVaryKey(key, vary, request)
+	}
+
+	entry := &CacheEntry{
+		Key:         key,
+		StatusCode:  statusCode,
 		Bytes:       _bytes,
+		Variants:    variants,
 		Header:      header,
 		LifeMs:      lifeMs,
 		ExpiredAtMs: nowMs + lifeMs,
+		StaleMs:     staleMs,
 		Tags:        tags,
+		Size:        cacheEntrySize(key, _bytes, variants, header),
+
+		ETag:                    etag,
+		LastModified:            lastModified,
+		IsETagGenerated:         isETagGenerated,
+		IsLastModifiedGenerated: isLastModifiedGenerated,
+	}
+	manager.setEntry(entry)
+	if disk != nil {
+		disk.put(entry)
 	}
+	return entry
+}
+
+// 写入条目
+func (manager *CacheManager) setEntry(entry *CacheEntry) {
+	// 超出缓存尺寸的不缓存
+	if entry.Size > manager.maxBytes() {
+		return
+	}
+
+	key := entry.Key
+	shard := manager.shard(key)
+	shard.mutex.Lock()
+	shard.deleteValue(key)
+	shard.mutex.Unlock()
+
+	// 先淘汰旧的条目，以便空出位置
+	manager.evict(entry.Size)
+
+	shard.mutex.Lock()
+	shard.deleteValue(key)
+	shard.values[key] = entry
+	shard.bytes += entry.Size
+	atomic.AddInt64(shard.totalBytes, entry.Size)
+	shard.policy.add(entry)
+	shard.sets++
 
 	//设置tag
-	if len(tags) > 0 {
-		for _, tag := range tags {
-			keyMapping, ok := manager.Tags[tag]
-			if !ok {
-				keyMapping = make(map[string]string)
-			}
+	for _, tag := range entry.Tags {
+		keyMapping, ok := shard.tags[tag]
+		if !ok {
+			keyMapping = map[string]bool{}
+			shard.tags[tag] = keyMapping
+		}
+		keyMapping[key] = true
+	}
+	shard.mutex.Unlock()
+
+	// 同时写入的条目可能超出尺寸
+	manager.evict(0)
+}
 
-			keyMapping[key] = ""
-			manager.Tags[tag] = keyMapping
+// 取得条目内容，返回的条目可能已经过期，需要使用isStale()判断
+// 如果缓存时有Vary头部，则按照请求中对应的头部查找变体
+func (manager *CacheManager) get(key string, request *http.Request) (entry *CacheEntry, ok bool) {
+	entry, ok = manager.lookup(key)
+	if ok && len(entry.Vary) > 0 {
+		if request == nil {
+			return nil, false
 		}
+		key = buildVaryKey(key, entry.Vary, request)
+		entry, ok = manager.lookup(key)
 	}
+	return
 }
 
-// 取得条目内容
-func (manager *CacheManager) get(key string) (entry CacheEntry, ok bool) {
-	if manager.Values == nil {
-		ok = false
+// 查找条目，内存中没有时从磁盘缓存中读取，并放回内存中
+func (manager *CacheManager) lookup(key string) (entry *CacheEntry, ok bool) {
+	entry, ok = manager.shard(key).lookup(key)
+	if ok {
 		return
 	}
 
-	entry, ok = manager.Values[key]
+	disk := manager.findDisk()
+	if disk == nil {
+		return
+	}
+
+	entry, ok = disk.read(key)
+	if ok {
+		entry.Size = cacheEntrySize(entry.Key, entry.Bytes, entry.Variants, entry.Header)
+		manager.setEntry(entry)
+	}
+	return
+}
+
+// 在分片中查找条目
+func (shard *cacheShard) lookup(key string) (entry *CacheEntry, ok bool) {
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry, ok = shard.values[key]
 	if !ok {
+		shard.misses++
 		return
 	}
 
-	if entry.ExpiredAtMs < int64(time.Now().UnixNano()/1000000) {
-		manager.deleteValue(key)
+	nowMs := time.Now().UnixNano() / 1000000
+	if entry.ExpiredAtMs+entry.StaleMs < nowMs {
+		shard.deleteValue(key)
+		shard.expires++
+		shard.misses++
 		ok = false
 		return
 	}
 
+	shard.policy.access(entry)
+
+	// 只记录Vary的条目不计入命中数
+	if len(entry.Vary) == 0 {
+		if entry.ExpiredAtMs < nowMs {
+			shard.stales++
+		} else {
+			shard.hits++
+		}
+	}
+
 	ok = true
 
 	return
 }
 
-// 删除某个key
-func (manager *CacheManager) deleteValue(key string) {
-	manager.Mutex.Lock()
-	defer manager.Mutex.Unlock()
+// 开始后台刷新某个键，如果已经在刷新中则返回false
+func (manager *CacheManager) startRevalidate(key string) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 
-	if manager.Values == nil {
-		return
+	if manager.revalidatingKeys == nil {
+		manager.revalidatingKeys = map[string]bool{}
 	}
-
-	entry, ok := manager.Values[key]
-	if !ok {
-		return
+	if manager.revalidatingKeys[key] {
+		return false
 	}
+	manager.revalidatingKeys[key] = true
+	return true
+}
 
-	delete(manager.Values, key)
+// 结束后台刷新某个键
+func (manager *CacheManager) finishRevalidate(key string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 
-	if entry.Tags != nil && len(entry.Tags) > 0 {
-		for _, tagName := range entry.Tags {
-			keyMap, ok := manager.Tags[tagName]
-			if !ok {
-				continue
-			}
+	delete(manager.revalidatingKeys, key)
+}
 
-			delete(keyMap, key)
+// 判断条目是否已经过期
+func (entry *CacheEntry) isStale() bool {
+	return entry.ExpiredAtMs < time.Now().UnixNano()/1000000
+}
 
-			if len(keyMap) == 0 {
-				delete(manager.Tags, tagName)
-			}
-		}
+// 判断条目是否在过期后的某个时间窗口内
+func (entry *CacheEntry) isStaleWithin(windowMs int64) bool {
+	return windowMs > 0 && time.Now().UnixNano()/1000000-entry.ExpiredAtMs <= windowMs
+}
+
+// 条目的响应状态码，之前版本保存的条目没有状态码，当作200
+func (entry *CacheEntry) responseStatus() int {
+	if entry.StatusCode == 0 {
+		return http.StatusOK
 	}
+	return entry.StatusCode
 }
 
 // 统计标签信息
@@ -209,31 +564,284 @@ func (manager *CacheManager) deleteValue(key string) {
 func (manager *CacheManager) statTag(tag string) (count int, keys []string, ok bool) {
 	keys = []string{}
 
-	if manager.Tags == nil {
-		ok = false
-		return
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+
+		keyMap, found := shard.tags[tag]
+		if found {
+			ok = true
+			count += len(keyMap)
+
+			for key := range keyMap {
+				if len(keys) >= 1000 {
+					break
+				}
+				keys = append(keys, key)
+			}
+		}
+
+		shard.mutex.Unlock()
 	}
 
-	keyMap, ok := manager.Tags[tag]
+	return
+}
+
+// 统计缓存信息
+func (manager *CacheManager) stat() Map {
+	var entries int
+	var bytes, hits, misses, sets, evictions, expires, stales int64
+
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+		entries += len(shard.values)
+		bytes += shard.bytes
+		hits += shard.hits
+		misses += shard.misses
+		sets += shard.sets
+		evictions += shard.evictions
+		expires += shard.expires
+		stales += shard.stales
+		shard.mutex.Unlock()
+	}
+
+	result := Map{
+		"entries":   entries,
+		"bytes":     bytes,
+		"shards":    CACHE_SHARDS,
+		"hits":      hits,
+		"misses":    misses,
+		"sets":      sets,
+		"evictions": evictions,
+		"expires":   expires,
+		"stales":    stales,
+		"hitRatio":  0.0,
+	}
+	if hits+misses > 0 {
+		result["hitRatio"] = float64(hits) / float64(hits+misses)
+	}
+
+	manager.mutex.Lock()
+	result["maxBytes"] = manager.MaxBytes
+	result["policy"] = manager.Policy
+	disk := manager.disk
+	manager.mutex.Unlock()
+
+	if disk != nil {
+		result["disk"] = disk.stat()
+	}
+
+	return result
+}
+
+// 最大尺寸
+func (manager *CacheManager) maxBytes() int64 {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.MaxBytes
+}
+
+// 淘汰条目直到可以放下指定尺寸的内容
+// 每次比较所有分片中最先淘汰的条目，淘汰其中最应该淘汰的，不需要加锁
+func (manager *CacheManager) evict(size int64) {
+	maxBytes := manager.maxBytes()
+	for atomic.LoadInt64(&manager.bytes)+size > maxBytes {
+		var victimShard *cacheShard
+		var victim *CacheEntry // 只复制淘汰策略使用的数据，避免在分片锁外读取条目
+		for _, shard := range manager.shards {
+			shard.mutex.Lock()
+			entry := shard.policy.victim()
+			if entry != nil && (victim == nil || shard.policy.before(entry, victim)) {
+				victimShard = shard
+				victim = &CacheEntry{
+					Key:        entry.Key,
+					frequency:  entry.frequency,
+					accessedAt: entry.accessedAt,
+				}
+			}
+			shard.mutex.Unlock()
+		}
+		if victimShard == nil {
+			return
+		}
+
+		victimShard.mutex.Lock()
+		if _, ok := victimShard.values[victim.Key]; ok {
+			victimShard.deleteValue(victim.Key)
+			victimShard.evictions++
+		}
+		victimShard.mutex.Unlock()
+	}
+}
+
+// 删除某个key，调用前需要加锁
+func (shard *cacheShard) deleteValue(key string) {
+	entry, ok := shard.values[key]
 	if !ok {
-		ok = false
 		return
 	}
 
-	ok = true
+	delete(shard.values, key)
+	shard.bytes -= entry.Size
+	atomic.AddInt64(shard.totalBytes, -entry.Size)
+	shard.policy.remove(entry)
 
-	count = len(keyMap)
+	for _, tagName := range entry.Tags {
+		keyMap, ok := shard.tags[tagName]
+		if !ok {
+			continue
+		}
 
-	i := 0
-	for key := range keyMap {
-		if i >= 1000 {
-			break
+		delete(keyMap, key)
+
+		if len(keyMap) == 0 {
+			delete(shard.tags, tagName)
 		}
+	}
+}
+
+// 复制头部，去除跟单次请求相关的头部
+func cloneCacheHeader(header http.Header) http.Header {
+	result := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Ratelimit-") || name == "Retry-After" || name == ACCESS_LOG_REQUEST_ID_HEADER {
+			continue
+		}
+		result[name] = append([]string{}, values...)
+	}
+	return result
+}
 
-		keys = append(keys, key)
+// 估算条目占用的字节数
+func cacheEntrySize(key string, _bytes []byte, variants map[string][]byte, header http.Header) int64 {
+	size := int64(CACHE_ENTRY_OVERHEAD + len(key) + len(_bytes))
+	for encoding, variant := range variants {
+		size += int64(len(encoding) + len(variant))
+	}
+	for name, values := range header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
 
-		i ++
+// 创建淘汰策略
+func newCachePolicy(policy string) cachePolicy {
+	if policy == CACHE_POLICY_LFU {
+		return &cacheLFUPolicy{}
 	}
+	return &cacheLRUPolicy{
+		list: list.New(),
+	}
+}
 
-	return
+// LRU：淘汰最久没有访问的条目
+type cacheLRUPolicy struct {
+	list *list.List
+}
+
+func (policy *cacheLRUPolicy) add(entry *CacheEntry) {
+	entry.accessedAt = time.Now().UnixNano()
+	entry.element = policy.list.PushFront(entry)
+}
+
+func (policy *cacheLRUPolicy) access(entry *CacheEntry) {
+	if entry.element != nil {
+		entry.accessedAt = time.Now().UnixNano()
+		policy.list.MoveToFront(entry.element)
+	}
+}
+
+func (policy *cacheLRUPolicy) remove(entry *CacheEntry) {
+	if entry.element != nil {
+		policy.list.Remove(entry.element)
+		entry.element = nil
+	}
+}
+
+func (policy *cacheLRUPolicy) victim() *CacheEntry {
+	element := policy.list.Back()
+	if element == nil {
+		return nil
+	}
+	return element.Value.(*CacheEntry)
+}
+
+func (policy *cacheLRUPolicy) before(entry1 *CacheEntry, entry2 *CacheEntry) bool {
+	return entry1.accessedAt < entry2.accessedAt
+}
+
+// LFU：淘汰访问次数最少的条目，次数相同时淘汰最久没有访问的
+type cacheLFUPolicy struct {
+	entries []*CacheEntry
+}
+
+func (policy *cacheLFUPolicy) Len() int {
+	return len(policy.entries)
+}
+
+func (policy *cacheLFUPolicy) Less(i, j int) bool {
+	if policy.entries[i].frequency == policy.entries[j].frequency {
+		return policy.entries[i].accessedAt < policy.entries[j].accessedAt
+	}
+	return policy.entries[i].frequency < policy.entries[j].frequency
+}
+
+func (policy *cacheLFUPolicy) Swap(i, j int) {
+	policy.entries[i], policy.entries[j] = policy.entries[j], policy.entries[i]
+	policy.entries[i].heapIndex = i
+	policy.entries[j].heapIndex = j
+}
+
+func (policy *cacheLFUPolicy) Push(x interface{}) {
+	entry := x.(*CacheEntry)
+	entry.heapIndex = len(policy.entries)
+	policy.entries = append(policy.entries, entry)
+}
+
+func (policy *cacheLFUPolicy) Pop() interface{} {
+	count := len(policy.entries)
+	entry := policy.entries[count-1]
+	policy.entries[count-1] = nil
+	policy.entries = policy.entries[:count-1]
+	entry.heapIndex = -1
+	return entry
+}
+
+func (policy *cacheLFUPolicy) add(entry *CacheEntry) {
+	entry.frequency = 1
+	entry.accessedAt = time.Now().UnixNano()
+	heap.Push(policy, entry)
+}
+
+func (policy *cacheLFUPolicy) access(entry *CacheEntry) {
+	if entry.heapIndex < 0 || entry.heapIndex >= len(policy.entries) {
+		return
+	}
+	entry.frequency++
+	entry.accessedAt = time.Now().UnixNano()
+	heap.Fix(policy, entry.heapIndex)
+}
+
+func (policy *cacheLFUPolicy) remove(entry *CacheEntry) {
+	if entry.heapIndex < 0 || entry.heapIndex >= len(policy.entries) || policy.entries[entry.heapIndex] != entry {
+		return
+	}
+	heap.Remove(policy, entry.heapIndex)
+}
+
+func (policy *cacheLFUPolicy) victim() *CacheEntry {
+	if len(policy.entries) == 0 {
+		return nil
+	}
+	return policy.entries[0]
+}
+
+func (policy *cacheLFUPolicy) before(entry1 *CacheEntry, entry2 *CacheEntry) bool {
+	if entry1.frequency == entry2.frequency {
+		return entry1.accessedAt < entry2.accessedAt
+	}
+	return entry1.frequency < entry2.frequency
 }
@@ -0,0 +1,266 @@
+package MeloyApi
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 默认的缓存键模板，包含调用者，避免不同的用户共享缓存
+const CACHE_DEFAULT_KEY = "${method} ${path}?${query} ${consumer}"
+
+// 请求上下文中的缓存标记
+type cacheContextKey string
+
+// 后台刷新缓存的请求标记
+const cacheRevalidateContextKey cacheContextKey = "revalidate"
+
+// API缓存配置
+type ApiCacheConfig struct {
+	Key     string   `json:"key"`     // 缓存键模板，比如 ${method} ${path}?${query:page,size} ${header:Accept-Language} ${consumer}
+	Methods []string `json:"methods"` // 可以缓存的请求方法，默认为GET和HEAD
+
+	TTL                 string   `json:"ttl"`                 // 缓存时间，比如 30s, 10m, 1h
+	Tags                []string `json:"tags"`                // 缓存标签
+	Statuses            []int    `json:"statuses"`            // 可以缓存的状态码，默认为200
+	MaxSize             string   `json:"maxSize"`             // 单个条目最大尺寸，比如 1m
+	RespectCacheControl bool     `json:"respectCacheControl"` // 是否遵循API服务器返回的Cache-Control
+
+	StaleWhileRevalidate string `json:"staleWhileRevalidate"` // 过期后仍然返回旧内容并在后台刷新的时间，比如 30s
+	StaleIfError         string `json:"staleIfError"`         // API服务器出错时仍然返回旧内容的时间，比如 10m
+
+	Coalesce        bool   `json:"coalesce"`        // 是否合并相同缓存键的请求
+	CoalesceTimeout string `json:"coalesceTimeout"` // 等待合并请求结果的超时时间，默认为API的超时时间
+}
+
+// 缓存键模板
+type cacheKeyTemplate struct {
+	pieces []cacheKeyPiece
+}
+
+// 缓存键模板片段
+type cacheKeyPiece struct {
+	variable string // 为空表示普通文本
+	text     string
+	names    []string
+}
+
+// 分析缓存键模板
+// 支持的变量：${method}, ${host}, ${path}, ${uri}, ${query}, ${query:参数1,参数2}, ${header:名称}, ${consumer}
+func parseCacheKeyTemplate(template string) (result *cacheKeyTemplate, err error) {
+	if len(template) == 0 {
+		template = CACHE_DEFAULT_KEY
+	}
+
+	reg, err := ReuseRegexpCompile("\\$\\{(\\w+)(?::([^}]*))?}")
+	if err != nil {
+		return
+	}
+
+	result = &cacheKeyTemplate{}
+	lastIndex := 0
+	for _, match := range reg.FindAllStringSubmatchIndex(template, -1) {
+		if match[0] > lastIndex {
+			result.pieces = append(result.pieces, cacheKeyPiece{
+				text: template[lastIndex:match[0]],
+			})
+		}
+		lastIndex = match[1]
+
+		piece := cacheKeyPiece{
+			variable: template[match[2]:match[3]],
+		}
+		if match[4] >= 0 {
+			for _, name := range strings.Split(template[match[4]:match[5]], ",") {
+				name = strings.TrimSpace(name)
+				if len(name) > 0 {
+					piece.names = append(piece.names, name)
+				}
+			}
+		}
+
+		switch piece.variable {
+		case "method", "host", "path", "uri", "consumer":
+		case "query":
+			sort.Strings(piece.names)
+		case "header":
+			if len(piece.names) == 0 {
+				err = errors.New("cache key: header name should be set, such as ${header:Accept-Language}")
+				return
+			}
+		default:
+			err = errors.New("cache key: unknown variable '${" + piece.variable + "}'")
+			return
+		}
+
+		result.pieces = append(result.pieces, piece)
+	}
+
+	if lastIndex < len(template) {
+		result.pieces = append(result.pieces, cacheKeyPiece{
+			text: template[lastIndex:],
+		})
+	}
+
+	return
+}
+
+// 请求是否可以使用缓存
+// 有Authorization头部但缓存键中没有这个头部时不使用缓存，避免把一个用户的响应返回给另外一个用户
+func (template *cacheKeyTemplate) allows(request *http.Request) bool {
+	if len(request.Header.Get("Authorization")) == 0 {
+		return true
+	}
+
+	for _, piece := range template.pieces {
+		if piece.variable != "header" {
+			continue
+		}
+		for _, name := range piece.names {
+			if http.CanonicalHeaderKey(name) == "Authorization" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 根据请求生成缓存键
+func (template *cacheKeyTemplate) build(request *http.Request, consumer string) string {
+	result := []string{}
+	for _, piece := range template.pieces {
+		switch piece.variable {
+		case "":
+			result = append(result, piece.text)
+		case "method":
+			result = append(result, strings.ToUpper(request.Method))
+		case "host":
+			result = append(result, request.Host)
+		case "path":
+			result = append(result, request.URL.Path)
+		case "uri":
+			result = append(result, request.URL.RequestURI())
+		case "consumer":
+			result = append(result, consumer)
+		case "query":
+			query := request.URL.Query()
+			if len(piece.names) > 0 {
+				selected := url.Values{}
+				for _, name := range piece.names {
+					if values, ok := query[name]; ok {
+						selected[name] = values
+					}
+				}
+				query = selected
+			}
+
+			// Encode()会按照参数名排序
+			result = append(result, query.Encode())
+		case "header":
+			values := []string{}
+			for _, name := range piece.names {
+				values = append(values, name+"="+strings.Join(request.Header[http.CanonicalHeaderKey(name)], ","))
+			}
+			result = append(result, strings.Join(values, "&"))
+		}
+	}
+	return strings.Join(result, "")
+}
+
+// 分析响应中的Vary头部，如果包含*则返回false，表示不能缓存
+func parseVaryHeader(header http.Header) (names []string, ok bool) {
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if len(name) == 0 {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+
+			name = http.CanonicalHeaderKey(name)
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// 根据Vary中的头部生成变体的缓存键
+func buildVaryKey(key string, vary []string, request *http.Request) string {
+	pieces := []string{key}
+	for _, name := range vary {
+		pieces = append(pieces, name+"="+strings.Join(request.Header[name], ","))
+	}
+	return strings.Join(pieces, "\n")
+}
+
+// 分析Cache-Control头部
+// 返回s-maxage或者max-age对应的缓存时间，如果有no-store、no-cache或者private则表示不能缓存
+func parseCacheControl(header http.Header) (lifeMs int64, hasLife bool, isCacheable bool) {
+	isCacheable = true
+
+	var maxAge int64 = -1
+	var sMaxAge int64 = -1
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			name := directive
+			arg := ""
+			if index := strings.Index(directive, "="); index > 0 {
+				name = directive[:index]
+				arg = strings.Trim(directive[index+1:], "\"")
+			}
+
+			switch name {
+			case "no-store", "no-cache", "private":
+				isCacheable = false
+			case "max-age":
+				seconds, err := strconv.ParseInt(arg, 10, 64)
+				if err == nil {
+					maxAge = seconds
+				}
+			case "s-maxage":
+				seconds, err := strconv.ParseInt(arg, 10, 64)
+				if err == nil {
+					sMaxAge = seconds
+				}
+			}
+		}
+	}
+
+	if !isCacheable {
+		return
+	}
+
+	if sMaxAge >= 0 {
+		return sMaxAge * 1000, true, true
+	}
+	if maxAge >= 0 {
+		return maxAge * 1000, true, true
+	}
+	return
+}
+
+// 分析缓存相关的时间设置，返回毫秒数
+func parseCachePeriodMs(period string) int64 {
+	duration, err := parsePeriodFromString(period)
+	if err != nil {
+		log.Println("Error:cache " + err.Error())
+		return 0
+	}
+	return int64(duration / time.Millisecond)
+}
+
+// 判断是否为后台刷新缓存的请求
+func isCacheRevalidating(request *http.Request) bool {
+	return request.Context().Value(cacheRevalidateContextKey) != nil
+}
@@ -0,0 +1,476 @@
+package MeloyApi
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 磁盘缓存目录，相对于应用目录
+const CACHE_DISK_DIR = "data/cache"
+
+// 磁盘缓存写入队列长度，队列满时放弃写入
+const CACHE_DISK_QUEUE_SIZE = 1024
+
+// 磁盘缓存配置
+type CacheDiskConfig struct {
+	MaxSize string // 最大尺寸，比如 1g，不设置则不启用磁盘缓存
+}
+
+// 磁盘缓存
+// 每个条目保存在以键的哈希值命名的文件中，索引和标签保存在index.json中
+type CacheDisk struct {
+	dir      string
+	maxBytes int64
+	bytes    int64
+
+	values map[string]*CacheEntry     // 条目的元数据，不包含内容和头部
+	tags   map[string]map[string]bool // tag => { key => true }
+	policy cachePolicy
+
+	queue     chan *CacheEntry
+	pending   map[string]*CacheEntry // 等待写入的条目，key => entry，删除条目时一并删除，避免写入已经删除的条目
+	isChanged bool
+
+	// 计数
+	hits      int64
+	writes    int64
+	evictions int64
+	drops     int64
+
+	mutex sync.Mutex
+}
+
+// 打开磁盘缓存，并加载索引
+func newCacheDisk(dir string, maxBytes int64) *CacheDisk {
+	disk := &CacheDisk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		values:   map[string]*CacheEntry{},
+		tags:     map[string]map[string]bool{},
+		policy:   newCachePolicy(CACHE_POLICY_LRU),
+		queue:    make(chan *CacheEntry, CACHE_DISK_QUEUE_SIZE),
+		pending:  map[string]*CacheEntry{},
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+
+	disk.load()
+
+	go func() {
+		for entry := range disk.queue {
+			disk.write(entry)
+		}
+	}()
+
+	return disk
+}
+
+// 从index.json中加载索引，索引中没有的文件（比如上次保存索引之后写入的）从文件内容中恢复
+func (disk *CacheDisk) load() {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	metas := []*CacheEntry{}
+	data, err := ioutil.ReadFile(disk.dir + "/index.json")
+	if err == nil {
+		err = json.Unmarshal(data, &metas)
+		if err != nil {
+			log.Println("Error:cache index:" + err.Error())
+		}
+	}
+
+	nowMs := time.Now().UnixNano() / 1000000
+	files := map[string]bool{}
+	for _, meta := range metas {
+		if meta.ExpiredAtMs+meta.StaleMs < nowMs {
+			continue
+		}
+
+		// 文件尺寸和索引不一致时说明保存索引之后又写入过，从文件中恢复
+		file := disk.file(meta.Key)
+		info, err := os.Stat(file)
+		if err != nil || info.Size() != meta.Size {
+			continue
+		}
+
+		disk.addMeta(meta)
+		files[file] = true
+	}
+
+	filepath.Walk(disk.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Base(path) == "index.json" || files[path] {
+			return nil
+		}
+
+		meta, ok := disk.loadFile(path, info.Size(), nowMs)
+		if !ok {
+			os.Remove(path)
+			return nil
+		}
+		disk.addMeta(meta)
+		return nil
+	})
+
+	disk.evict(0)
+}
+
+// 从条目文件中恢复元数据，文件损坏、过期或者和键不对应时返回false
+func (disk *CacheDisk) loadFile(path string, size int64, nowMs int64) (meta *CacheEntry, ok bool) {
+	if filepath.Ext(path) == ".tmp" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	entry := &CacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || len(entry.Key) == 0 || disk.file(entry.Key) != path {
+		return
+	}
+	if entry.ExpiredAtMs+entry.StaleMs < nowMs {
+		return
+	}
+
+	return &CacheEntry{
+		Key:         entry.Key,
+		LifeMs:      entry.LifeMs,
+		ExpiredAtMs: entry.ExpiredAtMs,
+		StaleMs:     entry.StaleMs,
+		Tags:        entry.Tags,
+		Size:        size,
+		Vary:        entry.Vary,
+	}, true
+}
+
+// 把索引写入index.json
+func (disk *CacheDisk) dump() {
+	disk.mutex.Lock()
+	if !disk.isChanged {
+		disk.mutex.Unlock()
+		return
+	}
+
+	metas := []*CacheEntry{}
+	for _, meta := range disk.values {
+		metas = append(metas, meta)
+	}
+	data, err := json.Marshal(metas)
+	disk.isChanged = false
+	disk.mutex.Unlock()
+
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return
+	}
+
+	err = writeFileAtomic(disk.dir+"/index.json", data)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+}
+
+// 修改最大尺寸
+func (disk *CacheDisk) resize(maxBytes int64) {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	disk.maxBytes = maxBytes
+	disk.evict(0)
+}
+
+// 放入写入队列
+func (disk *CacheDisk) put(entry *CacheEntry) {
+	disk.mutex.Lock()
+	disk.pending[entry.Key] = entry
+	disk.mutex.Unlock()
+
+	select {
+	case disk.queue <- entry:
+	default:
+		disk.mutex.Lock()
+		if disk.pending[entry.Key] == entry {
+			delete(disk.pending, entry.Key)
+		}
+		disk.drops++
+		disk.mutex.Unlock()
+	}
+}
+
+// 写入条目
+func (disk *CacheDisk) write(entry *CacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return
+	}
+
+	size := int64(len(data))
+
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	// 放入队列后已经被删除，或者已经有更新的条目等待写入
+	if disk.pending[entry.Key] != entry {
+		return
+	}
+	delete(disk.pending, entry.Key)
+
+	if size > disk.maxBytes {
+		return
+	}
+
+	disk.deleteValue(entry.Key)
+	disk.evict(size)
+
+	file := disk.file(entry.Key)
+	err = os.MkdirAll(filepath.Dir(file), 0777)
+	if err == nil {
+		err = writeFileAtomic(file, data)
+	}
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return
+	}
+
+	disk.addMeta(&CacheEntry{
+		Key:         entry.Key,
+		LifeMs:      entry.LifeMs,
+		ExpiredAtMs: entry.ExpiredAtMs,
+		StaleMs:     entry.StaleMs,
+		Tags:        entry.Tags,
+		Size:        size,
+		Vary:        entry.Vary,
+	})
+	disk.writes++
+}
+
+// 读取条目
+func (disk *CacheDisk) read(key string) (entry *CacheEntry, ok bool) {
+	disk.mutex.Lock()
+	meta, found := disk.values[key]
+	if !found {
+		disk.mutex.Unlock()
+		return
+	}
+
+	if meta.ExpiredAtMs+meta.StaleMs < time.Now().UnixNano()/1000000 {
+		disk.deleteValue(key)
+		disk.mutex.Unlock()
+		return
+	}
+	disk.policy.access(meta)
+	disk.mutex.Unlock()
+
+	entry, ok = disk.readFile(key)
+	if !ok {
+		disk.mutex.Lock()
+		disk.deleteValue(key)
+		disk.mutex.Unlock()
+		return
+	}
+
+	disk.mutex.Lock()
+	disk.hits++
+	disk.mutex.Unlock()
+
+	return
+}
+
+// 从文件中读取条目
+func (disk *CacheDisk) readFile(key string) (entry *CacheEntry, ok bool) {
+	data, err := ioutil.ReadFile(disk.file(key))
+	if err != nil {
+		return
+	}
+
+	entry = &CacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || entry.Key != key {
+		return nil, false
+	}
+
+	ok = true
+	return
+}
+
+// 删除某个标签关联的条目
+func (disk *CacheDisk) deleteTag(tag string) (count int) {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	for key, entry := range disk.pending {
+		if containsString(entry.Tags, tag) {
+			delete(disk.pending, key)
+		}
+	}
+
+	keyMap, ok := disk.tags[tag]
+	if !ok {
+		return
+	}
+
+	for key := range keyMap {
+		disk.deleteValue(key)
+		count++
+	}
+	return
+}
+
+// 清除过期的条目
+func (disk *CacheDisk) clearExpired() {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	nowMs := time.Now().UnixNano() / 1000000
+	for key, meta := range disk.values {
+		if meta.ExpiredAtMs+meta.StaleMs < nowMs {
+			disk.deleteValue(key)
+		}
+	}
+}
+
+// 清除所有的条目
+func (disk *CacheDisk) clearAll() (count int) {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	disk.pending = map[string]*CacheEntry{}
+	for key := range disk.values {
+		disk.deleteValue(key)
+		count++
+	}
+	return
+}
+
+// 加载条目到内存中，最近写入的优先，直到加载的尺寸达到maxBytes
+func (disk *CacheDisk) warmUp(maxBytes int64, load func(entry *CacheEntry)) (count int) {
+	disk.mutex.Lock()
+	keys := []string{}
+	for key := range disk.values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return disk.values[keys[i]].ExpiredAtMs-disk.values[keys[i]].LifeMs > disk.values[keys[j]].ExpiredAtMs-disk.values[keys[j]].LifeMs
+	})
+	disk.mutex.Unlock()
+
+	var bytes int64
+	for _, key := range keys {
+		entry, ok := disk.read(key)
+		if !ok {
+			continue
+		}
+
+		entry.Size = cacheEntrySize(entry.Key, entry.Bytes, entry.Variants, entry.Header)
+		if bytes+entry.Size > maxBytes {
+			break
+		}
+		bytes += entry.Size
+
+		load(entry)
+		count++
+	}
+
+	return
+}
+
+// 统计信息
+func (disk *CacheDisk) stat() Map {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	return Map{
+		"entries":   len(disk.values),
+		"bytes":     disk.bytes,
+		"maxBytes":  disk.maxBytes,
+		"hits":      disk.hits,
+		"writes":    disk.writes,
+		"evictions": disk.evictions,
+		"drops":     disk.drops,
+	}
+}
+
+// 条目对应的文件，按照哈希值的前两位分目录
+func (disk *CacheDisk) file(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return disk.dir + "/" + name[:2] + "/" + name
+}
+
+// 添加条目的元数据，调用前需要加锁
+func (disk *CacheDisk) addMeta(meta *CacheEntry) {
+	disk.values[meta.Key] = meta
+	disk.bytes += meta.Size
+	disk.policy.add(meta)
+	disk.isChanged = true
+
+	for _, tag := range meta.Tags {
+		keyMapping, ok := disk.tags[tag]
+		if !ok {
+			keyMapping = map[string]bool{}
+			disk.tags[tag] = keyMapping
+		}
+		keyMapping[meta.Key] = true
+	}
+}
+
+// 淘汰条目直到可以放下指定尺寸的内容，调用前需要加锁
+func (disk *CacheDisk) evict(size int64) {
+	for disk.bytes+size > disk.maxBytes {
+		meta := disk.policy.victim()
+		if meta == nil {
+			return
+		}
+		disk.deleteValue(meta.Key)
+		disk.evictions++
+	}
+}
+
+// 删除条目和对应的文件，调用前需要加锁
+func (disk *CacheDisk) deleteValue(key string) {
+	meta, ok := disk.values[key]
+	if !ok {
+		return
+	}
+
+	delete(disk.values, key)
+	disk.bytes -= meta.Size
+	disk.policy.remove(meta)
+	disk.isChanged = true
+
+	for _, tag := range meta.Tags {
+		keyMapping, ok := disk.tags[tag]
+		if ok {
+			delete(keyMapping, key)
+			if len(keyMapping) == 0 {
+				delete(disk.tags, tag)
+			}
+		}
+	}
+
+	os.Remove(disk.file(key))
+}
+
+// 先写入临时文件再改名，避免写入一半的文件
+func writeFileAtomic(file string, data []byte) error {
+	tmpFile := file + ".tmp"
+	err := ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
@@ -0,0 +1,84 @@
+package MeloyApi
+
+import (
+	"net/http"
+	"time"
+)
+
+// 合并中的请求
+// 同一个缓存键同时只有一个请求转发到API服务器，其他请求等待并共享结果
+type CacheFlight struct {
+	done  chan bool
+	entry *CacheEntry // 可以共享的结果，为nil时表示等待的请求需要自行转发
+}
+
+// 加入合并的请求，如果是第一个请求则返回isLeader=true
+func (manager *CacheManager) joinFlight(key string) (flight *CacheFlight, isLeader bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.flights == nil {
+		manager.flights = map[string]*CacheFlight{}
+	}
+
+	flight, ok := manager.flights[key]
+	if ok {
+		return
+	}
+
+	flight = &CacheFlight{
+		done: make(chan bool),
+	}
+	manager.flights[key] = flight
+	isLeader = true
+	return
+}
+
+// 结束合并的请求，通知所有等待的请求
+func (manager *CacheManager) finishFlight(key string, flight *CacheFlight) {
+	manager.mutex.Lock()
+	if manager.flights[key] == flight {
+		delete(manager.flights, key)
+	}
+	manager.mutex.Unlock()
+
+	close(flight.done)
+}
+
+// 记录可以共享的结果，statuses为可以缓存的状态码
+// 状态码不在statuses中、有Vary或者Cache-Control为private、no-store、no-cache的响应不共享，等待的请求自行转发
+func (flight *CacheFlight) share(statusCode int, _bytes []byte, header http.Header, statuses []int) {
+	if !containsInt(statuses, statusCode) {
+		return
+	}
+
+	vary, ok := parseVaryHeader(header)
+	if !ok || len(vary) > 0 {
+		return
+	}
+
+	_, _, isCacheable := parseCacheControl(header)
+	if !isCacheable {
+		return
+	}
+
+	flight.entry = &CacheEntry{
+		StatusCode: statusCode,
+		Bytes:      _bytes,
+		Header:     cloneCacheHeader(header),
+	}
+}
+
+// 等待结果
+func (flight *CacheFlight) wait(timeout time.Duration) (entry *CacheEntry, ok bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-flight.done:
+		entry = flight.entry
+		ok = entry != nil
+	case <-timer.C:
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package MeloyApi
+
+import (
+	"sort"
+	"time"
+)
+
+// 列出匹配的键，包括内存和磁盘中的，按照键排序
+func (manager *CacheManager) keys(match func(key string) bool) []string {
+	keyMap := map[string]bool{}
+
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+		for key := range shard.values {
+			if match(key) {
+				keyMap[key] = true
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	if disk := manager.findDisk(); disk != nil {
+		disk.mutex.Lock()
+		for key := range disk.values {
+			if match(key) {
+				keyMap[key] = true
+			}
+		}
+		disk.mutex.Unlock()
+	}
+
+	keys := []string{}
+	for key := range keyMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 查看条目，不影响命中数和淘汰顺序
+func (manager *CacheManager) peek(key string) (entry *CacheEntry, tier string, ok bool) {
+	shard := manager.shard(key)
+	shard.mutex.Lock()
+	entry, ok = shard.values[key]
+	shard.mutex.Unlock()
+	if ok {
+		return entry, "memory", true
+	}
+
+	if disk := manager.findDisk(); disk != nil {
+		entry, ok = disk.peek(key)
+		if ok {
+			return entry, "disk", true
+		}
+	}
+
+	return
+}
+
+// 条目摘要信息，磁盘中的条目使用索引中的元数据，不读取文件
+func (manager *CacheManager) summary(key string) Map {
+	shard := manager.shard(key)
+	shard.mutex.Lock()
+	entry, ok := shard.values[key]
+	shard.mutex.Unlock()
+	tier := "memory"
+
+	if !ok {
+		if disk := manager.findDisk(); disk != nil {
+			entry, ok = disk.meta(key)
+			tier = "disk"
+		}
+	}
+	if !ok {
+		return Map{
+			"key": key,
+		}
+	}
+
+	nowMs := time.Now().UnixNano() / 1000000
+	return Map{
+		"key":    key,
+		"tier":   tier,
+		"size":   entry.Size,
+		"ttlMs":  entry.ExpiredAtMs - nowMs,
+		"isVary": len(entry.Vary) > 0,
+	}
+}
+
+// 删除匹配的条目
+func (manager *CacheManager) purge(match func(key string) bool) (count int) {
+	for _, shard := range manager.shards {
+		shard.mutex.Lock()
+		for key := range shard.values {
+			if match(key) {
+				shard.deleteValue(key)
+				count++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	if disk := manager.findDisk(); disk != nil {
+		diskCount := disk.purge(match)
+		if diskCount > count {
+			count = diskCount
+		}
+	}
+
+	return
+}
+
+// 查看磁盘中的条目
+func (disk *CacheDisk) peek(key string) (entry *CacheEntry, ok bool) {
+	disk.mutex.Lock()
+	meta, found := disk.values[key]
+	disk.mutex.Unlock()
+	if !found {
+		return
+	}
+
+	entry, ok = disk.readFile(key)
+	if ok {
+		entry.Size = meta.Size
+	}
+	return
+}
+
+// 取得磁盘中条目的元数据
+func (disk *CacheDisk) meta(key string) (meta *CacheEntry, ok bool) {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	meta, ok = disk.values[key]
+	return
+}
+
+// 删除磁盘中匹配的条目
+func (disk *CacheDisk) purge(match func(key string) bool) (count int) {
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	for key := range disk.pending {
+		if match(key) {
+			delete(disk.pending, key)
+		}
+	}
+	for key := range disk.values {
+		if match(key) {
+			disk.deleteValue(key)
+			count++
+		}
+	}
+	return
+}
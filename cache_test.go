@@ -0,0 +1,248 @@
+package MeloyApi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 并发读写、按标签删除和清除所有条目，包括磁盘缓存
+func TestCacheConcurrentShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meloy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldAppDir := appManager.AppDir
+	oldConfig := appConfig.Cache
+	defer func() {
+		appConfig.Cache = oldConfig
+		cacheManager.reloadConfig()
+		appManager.AppDir = oldAppDir
+	}()
+
+	appManager.AppDir = dir
+	appConfig.Cache = CacheConfig{
+		MaxSize: "256k",
+		Disk: CacheDiskConfig{
+			MaxSize: "512k",
+		},
+	}
+	cacheManager.init()
+	cacheManager.clearAll()
+
+	disk := cacheManager.findDisk()
+	if disk == nil {
+		t.Fatal("disk cache should be enabled")
+	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 2000; i++ {
+				key := "/key" + strconv.Itoa((g*2000+i)%500)
+				tag := "tag" + strconv.Itoa(i%8)
+
+				switch {
+				case i%997 == 0:
+					cacheManager.clearAll()
+				case i%13 == 0:
+					cacheManager.deleteTag(tag)
+				case i%3 == 0:
+					cacheManager.get(key, nil)
+				default:
+					cacheManager.set(key, nil, []string{tag}, 200, make([]byte, 100+i%400), nil, nil, 60000, 0)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	waitCacheDiskQueue(disk)
+
+	checkCacheCounts(t, disk)
+
+	// 再写入一批条目，确认分布在多个分片中
+	for i := 0; i < 200; i++ {
+		cacheManager.set("/last"+strconv.Itoa(i), nil, []string{"last"}, 200, make([]byte, 200), nil, nil, 60000, 0)
+	}
+	waitCacheDiskQueue(disk)
+	checkCacheCounts(t, disk)
+
+	usedShards := 0
+	for _, shard := range cacheManager.shards {
+		shard.mutex.Lock()
+		if len(shard.values) > 0 {
+			usedShards++
+		}
+		shard.mutex.Unlock()
+	}
+	if usedShards < CACHE_SHARDS/2 {
+		t.Fatal("entries should be distributed in shards, used:", usedShards)
+	}
+
+	// 大于MaxBytes/CACHE_SHARDS的条目也可以缓存，超出尺寸时从其他分片中淘汰
+	for i := 0; i < 4; i++ {
+		cacheManager.set("/large"+strconv.Itoa(i), nil, []string{"last"}, 200, make([]byte, 64*1024), nil, nil, 60000, 0)
+		if _, ok := cacheManager.get("/large"+strconv.Itoa(i), nil); !ok {
+			t.Fatal("large entry should be cached:", i)
+		}
+	}
+	waitCacheDiskQueue(disk)
+	checkCacheCounts(t, disk)
+
+	// 按标签删除
+	cacheManager.deleteTag("last")
+	waitCacheDiskQueue(disk)
+	checkCacheCounts(t, disk)
+	if count, _, _ := cacheManager.statTag("last"); count > 0 {
+		t.Fatal("tag 'last' should be deleted, count:", count)
+	}
+
+	// 清除所有条目
+	cacheManager.clearAll()
+	waitCacheDiskQueue(disk)
+	checkCacheCounts(t, disk)
+
+	stat := cacheManager.stat()
+	if stat["entries"].(int) != 0 || stat["bytes"].(int64) != 0 {
+		t.Fatal("memory cache should be empty:", stat)
+	}
+	diskStat := disk.stat()
+	if diskStat["entries"].(int) != 0 || diskStat["bytes"].(int64) != 0 {
+		t.Fatal("disk cache should be empty:", diskStat)
+	}
+}
+
+// 等待磁盘缓存写入队列中的条目写完
+func waitCacheDiskQueue(disk *CacheDisk) {
+	for i := 0; i < 500 && len(disk.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 最后一个条目可能正在写入
+	disk.mutex.Lock()
+	disk.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+}
+
+// 检查每个分片和磁盘缓存中的字节数、条目数和标签
+func checkCacheCounts(t *testing.T, disk *CacheDisk) {
+	var entries int
+	var bytes int64
+	for index, shard := range cacheManager.shards {
+		shard.mutex.Lock()
+
+		var shardBytes int64
+		for key, entry := range shard.values {
+			if entry.Key != key {
+				t.Error("shard", index, "key mismatch:", key, entry.Key)
+			}
+			shardBytes += entry.Size
+		}
+		if shardBytes != shard.bytes {
+			t.Error("shard", index, "bytes:", shard.bytes, "expected:", shardBytes)
+		}
+		for tag, keyMap := range shard.tags {
+			for key := range keyMap {
+				if _, ok := shard.values[key]; !ok {
+					t.Error("shard", index, "tag '"+tag+"' refers to deleted key:", key)
+				}
+			}
+		}
+
+		entries += len(shard.values)
+		bytes += shard.bytes
+		shard.mutex.Unlock()
+	}
+
+	stat := cacheManager.stat()
+	if stat["entries"].(int) != entries || stat["bytes"].(int64) != bytes {
+		t.Error("stat mismatch:", stat, entries, bytes)
+	}
+	if totalBytes := atomic.LoadInt64(&cacheManager.bytes); totalBytes != bytes {
+		t.Error("total bytes:", totalBytes, "expected:", bytes)
+	}
+	if bytes > cacheManager.MaxBytes {
+		t.Error("bytes exceeds max:", bytes, cacheManager.MaxBytes)
+	}
+
+	disk.mutex.Lock()
+	defer disk.mutex.Unlock()
+
+	var diskBytes int64
+	for _, meta := range disk.values {
+		diskBytes += meta.Size
+	}
+	if diskBytes != disk.bytes {
+		t.Error("disk bytes:", disk.bytes, "expected:", diskBytes)
+	}
+	if disk.bytes > disk.maxBytes {
+		t.Error("disk bytes exceeds max:", disk.bytes, disk.maxBytes)
+	}
+	for tag, keyMap := range disk.tags {
+		for key := range keyMap {
+			if _, ok := disk.values[key]; !ok {
+				t.Error("disk tag '"+tag+"' refers to deleted key:", key)
+			}
+		}
+	}
+
+	files := 0
+	filepath.Walk(disk.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Base(path) != "index.json" && !strings.HasSuffix(path, ".tmp") {
+			files++
+		}
+		return nil
+	})
+	if files != len(disk.values) {
+		t.Error("disk files:", files, "expected:", len(disk.values))
+	}
+}
+
+// 超出尺寸时淘汰所有分片中最久没有访问的条目
+func TestCacheEvictAcrossShards(t *testing.T) {
+	oldConfig := appConfig.Cache
+	defer func() {
+		appConfig.Cache = oldConfig
+		cacheManager.reloadConfig()
+	}()
+
+	appConfig.Cache = CacheConfig{
+		MaxSize: "64k",
+	}
+	cacheManager.init()
+	cacheManager.clearAll()
+
+	// 64k中可以放下6个10k的条目
+	for i := 0; i < 6; i++ {
+		cacheManager.set("/evict"+strconv.Itoa(i), nil, nil, 200, make([]byte, 10*1024), nil, nil, 60000, 0)
+		time.Sleep(time.Millisecond)
+	}
+	cacheManager.get("/evict0", nil)
+	cacheManager.set("/evict6", nil, nil, 200, make([]byte, 10*1024), nil, nil, 60000, 0)
+
+	if _, ok := cacheManager.get("/evict0", nil); !ok {
+		t.Fatal("recently accessed entry should be kept")
+	}
+	if _, ok := cacheManager.get("/evict6", nil); !ok {
+		t.Fatal("new entry should be cached")
+	}
+	if _, ok := cacheManager.get("/evict1", nil); ok {
+		t.Fatal("least recently used entry should be evicted")
+	}
+
+	stat := cacheManager.stat()
+	if stat["bytes"].(int64) > cacheManager.MaxBytes {
+		t.Fatal("bytes exceeds max:", stat)
+	}
+}
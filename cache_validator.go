@@ -0,0 +1,74 @@
+package MeloyApi
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 根据内容生成弱ETag
+func generateETag(_bytes []byte) string {
+	hash := fnv.New64a()
+	hash.Write(_bytes)
+	return "W/\"" + strconv.FormatUint(hash.Sum64(), 16) + "-" + strconv.FormatInt(int64(len(_bytes)), 16) + "\""
+}
+
+// 判断客户端缓存的内容是否仍然有效
+// 优先使用If-None-Match，没有时才使用If-Modified-Since
+func isNotModified(request *http.Request, header http.Header) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+
+	ifNoneMatch := request.Header.Get("If-None-Match")
+	if len(ifNoneMatch) > 0 {
+		etag := header.Get("ETag")
+		if len(etag) == 0 {
+			return false
+		}
+
+		for _, piece := range strings.Split(ifNoneMatch, ",") {
+			piece = strings.TrimSpace(piece)
+			if piece == "*" || strings.TrimPrefix(piece, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince := request.Header.Get("If-Modified-Since")
+	if len(ifModifiedSince) > 0 {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+
+		return !lastModified.After(since)
+	}
+
+	return false
+}
+
+// 判断条目是否有API服务器提供的验证信息，可以用来发起条件请求
+func (entry *CacheEntry) isRevalidatable() bool {
+	return !entry.IsETagGenerated || !entry.IsLastModifiedGenerated
+}
+
+// 在请求头部中加入条目的验证信息
+func (entry *CacheEntry) addConditionalHeaders(header http.Header) {
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+
+	if !entry.IsETagGenerated {
+		header.Set("If-None-Match", entry.ETag)
+	}
+	if !entry.IsLastModifiedGenerated {
+		header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
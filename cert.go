@@ -0,0 +1,150 @@
+package MeloyApi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// 客户端证书校验方式
+const (
+	CLIENT_AUTH_NONE    = "none"
+	CLIENT_AUTH_REQUEST = "request"
+	CLIENT_AUTH_REQUIRE = "require"
+)
+
+// 默认转发客户端证书身份的头部
+const CLIENT_CERT_DEFAULT_HEADER = "Meloy-Client-Cert"
+
+// API客户端证书规则
+type ApiClientCert struct {
+	Subjects []string `json:"subjects"` // 证书主题，比如 CN=partner.com,O=Partner，支持*通配符
+	SANs     []string `json:"sans"`     // 证书中的DNS、Email、IP、URI，支持*通配符
+}
+
+// 构造监听用的TLS配置
+func (manager *AppManager) buildTLSConfig() (config *tls.Config, err error) {
+	config = &tls.Config{}
+
+	mode := strings.ToLower(appConfig.SSL.ClientAuth)
+	if len(mode) == 0 {
+		if len(appConfig.SSL.ClientCA) > 0 {
+			mode = CLIENT_AUTH_REQUIRE
+		} else {
+			mode = CLIENT_AUTH_NONE
+		}
+	}
+
+	switch mode {
+	case CLIENT_AUTH_NONE:
+		config.ClientAuth = tls.NoClientCert
+		return
+	case CLIENT_AUTH_REQUEST:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		err = errors.New("invalid ssl.clientAuth '" + appConfig.SSL.ClientAuth + "', should be one of none, request, require")
+		return
+	}
+
+	if len(appConfig.SSL.ClientCA) == 0 {
+		err = errors.New("ssl.clientCA should be set when ssl.clientAuth is '" + mode + "'")
+		return
+	}
+
+	caBytes, err := ioutil.ReadFile(appConfig.SSL.ClientCA)
+	if err != nil {
+		return
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		err = errors.New("no valid certificates found in '" + appConfig.SSL.ClientCA + "'")
+		return
+	}
+	config.ClientCAs = pool
+
+	return
+}
+
+// 取得已校验的客户端证书
+func (manager *AppManager) findClientCert(request *http.Request) (cert *x509.Certificate, ok bool) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	return request.TLS.VerifiedChains[0][0], true
+}
+
+// 客户端证书对应的身份
+func (manager *AppManager) findClientCertIdentity(request *http.Request) string {
+	cert, ok := manager.findClientCert(request)
+	if !ok {
+		return ""
+	}
+
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// 校验客户端证书是否符合API规则
+func (manager *AppManager) validateClientCert(request *http.Request, api *Api) bool {
+	if !api.hasClientCertRules {
+		return true
+	}
+
+	cert, ok := manager.findClientCert(request)
+	if !ok {
+		return false
+	}
+
+	if len(api.ClientCert.Subjects) > 0 {
+		subject := cert.Subject.String()
+		for _, pattern := range api.ClientCert.Subjects {
+			if matchWildcard(pattern, subject) || matchWildcard(pattern, "CN="+cert.Subject.CommonName) {
+				return true
+			}
+		}
+	}
+
+	if len(api.ClientCert.SANs) > 0 {
+		names := []string{}
+		names = append(names, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+
+		for _, pattern := range api.ClientCert.SANs {
+			for _, name := range names {
+				if matchWildcard(pattern, name) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// 判断字符串是否匹配带*通配符的模式
+func matchWildcard(pattern string, s string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == s
+	}
+
+	reg, err := ReuseRegexpCompile("^" + strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1) + "$")
+	if err != nil {
+		return false
+	}
+	return reg.MatchString(s)
+}
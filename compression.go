@@ -0,0 +1,240 @@
+package MeloyApi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 支持的压缩方式
+const (
+	COMPRESSION_GZIP    = "gzip"
+	COMPRESSION_DEFLATE = "deflate"
+)
+
+// 默认的最小压缩尺寸
+const COMPRESSION_DEFAULT_MIN_SIZE = 1024
+
+// 默认压缩的内容类型
+var compressionDefaultTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/*+json",
+	"application/*+xml",
+}
+
+// API压缩配置
+type ApiCompressionConfig struct {
+	Encodings []string `json:"encodings"` // 压缩方式，支持gzip和deflate，按照优先级排列，为空表示不压缩
+	MinSize   string   `json:"minSize"`   // 最小压缩尺寸，默认为1k
+	Types     []string `json:"types"`     // 压缩的内容类型，支持*通配符，比如 text/*
+}
+
+// 压缩器
+type Compressor struct {
+	encodings []string
+	minSize   int64
+	types     []string
+}
+
+// 从配置构造压缩器，如果没有可用的压缩方式则返回nil
+func newCompressor(config ApiCompressionConfig) *Compressor {
+	compressor := &Compressor{
+		minSize: COMPRESSION_DEFAULT_MIN_SIZE,
+		types:   compressionDefaultTypes,
+	}
+
+	for _, encoding := range config.Encodings {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding != COMPRESSION_GZIP && encoding != COMPRESSION_DEFLATE {
+			log.Println("Error:unsupported compression encoding '" + encoding + "'")
+			continue
+		}
+		if !containsString(compressor.encodings, encoding) {
+			compressor.encodings = append(compressor.encodings, encoding)
+		}
+	}
+	if len(compressor.encodings) == 0 {
+		return nil
+	}
+
+	if len(config.MinSize) > 0 {
+		size, err := parseSizeFromString(config.MinSize)
+		if err != nil {
+			log.Println("Parse "+config.MinSize+" Error:", err.Error())
+		} else {
+			compressor.minSize = int64(size)
+		}
+	}
+
+	if len(config.Types) > 0 {
+		compressor.types = []string{}
+		for _, contentType := range config.Types {
+			compressor.types = append(compressor.types, strings.ToLower(strings.TrimSpace(contentType)))
+		}
+	}
+
+	return compressor
+}
+
+// 判断响应是否可以压缩
+func (compressor *Compressor) isCompressible(header http.Header, statusCode int, size int) bool {
+	if compressor == nil {
+		return false
+	}
+
+	if int64(size) < compressor.minSize || statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		return false
+	}
+
+	// 已经压缩过的不再压缩
+	if len(header.Get("Content-Encoding")) > 0 {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range compressor.types {
+		if matchWildcard(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据Accept-Encoding选择压缩方式，没有合适的则返回空字符串
+func (compressor *Compressor) negotiate(request *http.Request) string {
+	if compressor == nil {
+		return ""
+	}
+
+	type acceptedEncoding struct {
+		encoding string
+		quality  float64
+		index    int
+	}
+
+	accepted := []acceptedEncoding{}
+	for _, piece := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(piece, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) == 0 {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		for index, encoding := range compressor.encodings {
+			if name == encoding || name == "*" {
+				accepted = append(accepted, acceptedEncoding{
+					encoding: encoding,
+					quality:  quality,
+					index:    index,
+				})
+			}
+		}
+	}
+
+	if len(accepted) == 0 {
+		return ""
+	}
+
+	// 按照权重排序，权重相同时按照配置中的顺序
+	sort.SliceStable(accepted, func(i, j int) bool {
+		if accepted[i].quality == accepted[j].quality {
+			return accepted[i].index < accepted[j].index
+		}
+		return accepted[i].quality > accepted[j].quality
+	})
+	return accepted[0].encoding
+}
+
+// 使用所有的压缩方式压缩内容，用于写入缓存
+func (compressor *Compressor) compressAll(header http.Header, statusCode int, _bytes []byte) map[string][]byte {
+	if !compressor.isCompressible(header, statusCode, len(_bytes)) {
+		return nil
+	}
+
+	variants := map[string][]byte{}
+	for _, encoding := range compressor.encodings {
+		compressed, err := compressBytes(encoding, _bytes)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+		variants[encoding] = compressed
+	}
+	return variants
+}
+
+// 压缩内容
+func compressBytes(encoding string, _bytes []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+
+	var err error
+	switch encoding {
+	case COMPRESSION_GZIP:
+		writer := gzip.NewWriter(buffer)
+		_, err = writer.Write(_bytes)
+		if err == nil {
+			err = writer.Close()
+		}
+	case COMPRESSION_DEFLATE:
+		writer := zlib.NewWriter(buffer)
+		_, err = writer.Write(_bytes)
+		if err == nil {
+			err = writer.Close()
+		}
+	default:
+		err = errors.New("unsupported compression encoding '" + encoding + "'")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// 在ETag中加入压缩方式，以便区分压缩前后的内容
+func compressedETag(etag string, encoding string) string {
+	if len(etag) == 0 || !strings.HasSuffix(etag, "\"") {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + "\""
+}
+
+// 在Vary头部中加入Accept-Encoding
+func addVaryAcceptEncoding(header http.Header) {
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || http.CanonicalHeaderKey(name) == "Accept-Encoding" {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,192 @@
+package MeloyApi
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 并发配置
+type ConcurrencyConfig struct {
+	MaxConcurrent int `json:"maxConcurrent"` // 最大同时处理的请求数，0表示不限制
+
+	Queue struct {
+		Size    int    `json:"size"`    // 排队的最大请求数，0表示不排队
+		Timeout string `json:"timeout"` // 排队超时时间，比如 500ms, 2s，默认为1s
+	} `json:"queue"`
+}
+
+// 并发管理器
+type ConcurrencyManager struct {
+	limiters map[string]*ConcurrencyLimiter
+	inFlight int64 // 正在处理的所有请求数
+
+	mutex sync.Mutex
+}
+
+// 并发限制器
+type ConcurrencyLimiter struct {
+	Name   string
+	Config ConcurrencyConfig
+
+	slots        chan bool
+	queueTimeout time.Duration
+
+	inFlight int64
+	queued   int64
+	rejected int64
+}
+
+var concurrencyManager = ConcurrencyManager{
+	limiters: map[string]*ConcurrencyLimiter{},
+}
+
+// 取得限制器，配置不变时复用原来的限制器
+func (manager *ConcurrencyManager) find(name string, config ConcurrencyConfig) *ConcurrencyLimiter {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if config.MaxConcurrent <= 0 {
+		delete(manager.limiters, name)
+		return nil
+	}
+
+	limiter, ok := manager.limiters[name]
+	if ok && limiter.Config == config {
+		return limiter
+	}
+
+	limiter = &ConcurrencyLimiter{
+		Name:         name,
+		Config:       config,
+		slots:        make(chan bool, config.MaxConcurrent),
+		queueTimeout: 1 * time.Second,
+	}
+
+	if len(config.Queue.Timeout) > 0 {
+		timeout, err := time.ParseDuration(config.Queue.Timeout)
+		if err != nil {
+			log.Println("Error:queue timeout parse failed '" + config.Queue.Timeout + "'")
+		} else {
+			limiter.queueTimeout = timeout
+		}
+	}
+
+	manager.limiters[name] = limiter
+	return limiter
+}
+
+// 重新加载服务器的并发设置
+func (manager *ConcurrencyManager) reloadServers(servers []Server) {
+	for _, server := range servers {
+		manager.find("server:"+server.Code, server.Request.ConcurrencyConfig)
+	}
+}
+
+// 占用API和服务器的处理名额，返回释放名额的函数
+func (manager *ConcurrencyManager) acquire(api *Api, server string) (release func(), ok bool) {
+	limiters := []*ConcurrencyLimiter{}
+	if api.concurrencyLimiter != nil {
+		limiters = append(limiters, api.concurrencyLimiter)
+	}
+
+	manager.mutex.Lock()
+	serverLimiter, found := manager.limiters["server:"+server]
+	manager.mutex.Unlock()
+	if found {
+		limiters = append(limiters, serverLimiter)
+	}
+
+	for index, limiter := range limiters {
+		if !limiter.acquire() {
+			for i := index - 1; i >= 0; i-- {
+				limiters[i].release()
+			}
+			return
+		}
+	}
+
+	atomic.AddInt64(&manager.inFlight, 1)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			for _, limiter := range limiters {
+				limiter.release()
+			}
+			atomic.AddInt64(&manager.inFlight, -1)
+		})
+	}
+	ok = true
+	return
+}
+
+// 统计信息
+func (manager *ConcurrencyManager) stat() (limiters []Map, inFlight int64, queued int64) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	inFlight = atomic.LoadInt64(&manager.inFlight)
+	limiters = []Map{}
+	for _, limiter := range manager.limiters {
+		limiterQueued := atomic.LoadInt64(&limiter.queued)
+		queued += limiterQueued
+
+		limiters = append(limiters, Map{
+			"name":          limiter.Name,
+			"maxConcurrent": limiter.Config.MaxConcurrent,
+			"queueSize":     limiter.Config.Queue.Size,
+			"inFlight":      atomic.LoadInt64(&limiter.inFlight),
+			"queued":        limiterQueued,
+			"rejected":      atomic.LoadInt64(&limiter.rejected),
+		})
+	}
+
+	sort.Slice(limiters, func(i, j int) bool {
+		return limiters[i]["name"].(string) < limiters[j]["name"].(string)
+	})
+
+	return
+}
+
+// 占用名额，如果没有空闲名额则排队等待
+func (limiter *ConcurrencyLimiter) acquire() bool {
+	select {
+	case limiter.slots <- true:
+		atomic.AddInt64(&limiter.inFlight, 1)
+		return true
+	default:
+	}
+
+	if limiter.Config.Queue.Size <= 0 {
+		atomic.AddInt64(&limiter.rejected, 1)
+		return false
+	}
+
+	if atomic.AddInt64(&limiter.queued, 1) > int64(limiter.Config.Queue.Size) {
+		atomic.AddInt64(&limiter.queued, -1)
+		atomic.AddInt64(&limiter.rejected, 1)
+		return false
+	}
+	defer atomic.AddInt64(&limiter.queued, -1)
+
+	timer := time.NewTimer(limiter.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- true:
+		atomic.AddInt64(&limiter.inFlight, 1)
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&limiter.rejected, 1)
+		return false
+	}
+}
+
+// 释放名额
+func (limiter *ConcurrencyLimiter) release() {
+	atomic.AddInt64(&limiter.inFlight, -1)
+	<-limiter.slots
+}
@@ -40,9 +40,13 @@ func (manager *HookManager) beforeHook(writer http.ResponseWriter, request *http
 			}
 
 			canNext := false
+			span := findTraceSpan(request).child("hook.before", TRACE_SPAN_KIND_INTERNAL)
+			span.setAttribute("meloy.hook.index", index)
 			hook.BeforeFunc(context, func() {
 				canNext = true
 			})
+			span.setAttribute("meloy.hook.next", canNext)
+			span.end()
 			manager.hooks[index].IsAvailable = true
 			if !canNext {
 				canDo = false
@@ -67,7 +71,10 @@ func (manager *HookManager) afterHook(context *HookContext, response *http.Respo
 		for i := countHooks - 1; i >= 0; i -- {
 			hook := manager.hooks[i]
 			if hook.IsAvailable {
+				span := findTraceSpan(context.Request).child("hook.after", TRACE_SPAN_KIND_INTERNAL)
+				span.setAttribute("meloy.hook.index", i)
 				hook.AfterFunc(context)
+				span.end()
 			} else {
 				break
 			}
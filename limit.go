@@ -0,0 +1,661 @@
+package MeloyApi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限流算法
+const (
+	RATE_LIMIT_TOKEN_BUCKET   = "tokenBucket"
+	RATE_LIMIT_SLIDING_WINDOW = "slidingWindow"
+	RATE_LIMIT_QUOTA          = "quota"
+)
+
+// 限流配置
+type RateLimitConfig struct {
+	Algorithm string `json:"algorithm"` // tokenBucket（默认）、slidingWindow或者quota
+	Key       string `json:"key"`       // global, api, client, consumer, header:名称，多个用逗号隔开，比如 api,client
+	Requests  int    `json:"requests"`  // 每个周期的请求数
+	Period    string `json:"period"`    // 周期，比如 1s, 1m, 1h, 1d；quota只支持day和month
+	Burst     int    `json:"burst"`     // 令牌桶最多可以积攒的请求数，默认和requests相同
+}
+
+// 限流管理器
+type RateLimitManager struct {
+	limiters map[string]*RateLimiter
+
+	mutex sync.Mutex
+}
+
+// 限流器
+type RateLimiter struct {
+	Config RateLimitConfig
+
+	id         string
+	persistent bool // 是否需要保存到统计数据存储
+
+	scope    string
+	keys     []string
+	period   time.Duration
+	capacity float64
+	rate     float64 // 每纳秒的令牌数
+
+	buckets map[string]*rateLimitBucket
+
+	// 计数
+	allowed  int64
+	rejected int64
+
+	mutex sync.Mutex
+}
+
+// 限流计数
+type rateLimitBucket struct {
+	// 令牌桶
+	tokens float64
+
+	// 滑动窗口
+	windowStart int64
+	current     int
+	previous    int
+
+	updatedAt int64
+	isChanged bool
+}
+
+// 限流结果
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+
+	windowStart int64 // 消耗请求时所在的窗口，用于归还
+}
+
+// 已经消耗的请求
+type rateLimitTaken struct {
+	limiter *RateLimiter
+	key     string
+	result  RateLimitResult
+}
+
+var rateLimitManager = RateLimitManager{
+	limiters: map[string]*RateLimiter{},
+}
+var rateLimitInitOnce sync.Once
+
+// 初始化
+func (manager *RateLimitManager) init() {
+	rateLimitInitOnce.Do(func() {
+		// 加载统计数据存储打开之前创建的限流器的计数
+		manager.mutex.Lock()
+		for _, limiter := range manager.limiters {
+			if limiter.persistent {
+				manager.load(limiter)
+			}
+		}
+		manager.mutex.Unlock()
+
+		// 每分钟保存一次计数，并清理不再使用的计数
+		go func() {
+			tick := time.Tick(1 * time.Minute)
+			for {
+				<-tick
+
+				manager.dump()
+				manager.clearIdle()
+			}
+		}()
+	})
+}
+
+// 根据配置取得限流器，相同的配置会复用同一个限流器，以便重新加载配置后计数不丢失
+func (manager *RateLimitManager) find(scope string, configs []RateLimitConfig) (limiters []*RateLimiter) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, config := range configs {
+		configBytes, _ := json.Marshal(config)
+		id := scope + "@" + string(configBytes)
+
+		limiter, ok := manager.limiters[id]
+		if !ok {
+			var err error
+			limiter, err = newRateLimiter(scope, config)
+			if err != nil {
+				log.Println("Error:rate limit:" + err.Error())
+				continue
+			}
+			limiter.id = id
+			manager.limiters[id] = limiter
+
+			if limiter.persistent {
+				manager.load(limiter)
+			}
+		}
+
+		limiters = append(limiters, limiter)
+	}
+
+	return
+}
+
+// 删除不再使用的限流器，删除前保存需要持久化的计数
+func (manager *RateLimitManager) retain(limiters []*RateLimiter) {
+	used := map[string]bool{}
+	for _, limiter := range limiters {
+		used[limiter.id] = true
+	}
+
+	manager.mutex.Lock()
+	removed := []*RateLimiter{}
+	for id, limiter := range manager.limiters {
+		if !used[id] {
+			delete(manager.limiters, id)
+			removed = append(removed, limiter)
+		}
+	}
+	manager.mutex.Unlock()
+
+	store := statManager.store
+	if store == nil {
+		return
+	}
+	for _, limiter := range removed {
+		if !limiter.persistent {
+			continue
+		}
+		err := store.saveRateLimits(limiter.id, limiter.changedBuckets())
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	}
+}
+
+// 清理空闲的计数
+func (manager *RateLimitManager) clearIdle() {
+	manager.mutex.Lock()
+	limiters := []*RateLimiter{}
+	for _, limiter := range manager.limiters {
+		limiters = append(limiters, limiter)
+	}
+	manager.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	store := statManager.store
+	for _, limiter := range limiters {
+		keys := limiter.clearIdle(now)
+		if limiter.persistent && len(keys) > 0 && store != nil {
+			err := store.deleteRateLimits(limiter.id, keys)
+			if err != nil {
+				log.Println("Error:" + err.Error())
+			}
+		}
+	}
+}
+
+// 从统计数据存储中加载限流器的计数
+func (manager *RateLimitManager) load(limiter *RateLimiter) {
+	store := statManager.store
+	if store == nil {
+		return
+	}
+
+	if _, ok := store.(*MemoryStatStore); ok {
+		log.Println("Warning:rate limit counters of '" + limiter.id + "' will be lost after restart with memory stat store")
+	}
+
+	counters, err := store.findRateLimits(limiter.id)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for key, counter := range counters {
+		limiter.buckets[key] = &rateLimitBucket{
+			tokens:      counter.Tokens,
+			windowStart: counter.WindowStart,
+			current:     counter.Current,
+			previous:    counter.Previous,
+			updatedAt:   counter.UpdatedAt,
+		}
+	}
+}
+
+// 保存计数到统计数据存储
+func (manager *RateLimitManager) dump() {
+	manager.mutex.Lock()
+	limiters := []*RateLimiter{}
+	for _, limiter := range manager.limiters {
+		if limiter.persistent {
+			limiters = append(limiters, limiter)
+		}
+	}
+	manager.mutex.Unlock()
+
+	store := statManager.store
+	if len(limiters) == 0 || store == nil {
+		return
+	}
+
+	for _, limiter := range limiters {
+		err := store.saveRateLimits(limiter.id, limiter.changedBuckets())
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	}
+}
+
+// 校验请求是否超出限流，如果超出则输出429
+func (manager *RateLimitManager) check(writer http.ResponseWriter, request *http.Request, api *Api) bool {
+	limiters := append([]*RateLimiter{}, appConfig.rateLimiters...)
+	limiters = append(limiters, api.rateLimiters...)
+	if len(limiters) == 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+
+	var strictest *RateLimitResult
+	takens := []rateLimitTaken{}
+	for _, limiter := range limiters {
+		key := limiter.buildKey(request, api)
+		result := limiter.take(key, now)
+
+		if !result.Allowed {
+			// 归还之前的限流器已经消耗的请求，避免被拒绝的请求消耗其他限流器的配额
+			for _, taken := range takens {
+				taken.limiter.refund(taken.key, taken.result)
+			}
+
+			manager.writeHeaders(writer, result)
+			writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(result.RetryAfter.Seconds())), 10))
+			http.Error(writer, "API requests limit reached", http.StatusTooManyRequests)
+			return false
+		}
+
+		if strictest == nil || result.Remaining < strictest.Remaining {
+			r := result
+			strictest = &r
+		}
+		takens = append(takens, rateLimitTaken{
+			limiter: limiter,
+			key:     key,
+			result:  result,
+		})
+	}
+
+	for _, taken := range takens {
+		taken.limiter.countAllowed()
+	}
+
+	manager.writeHeaders(writer, *strictest)
+	return true
+}
+
+// 统计信息
+func (manager *RateLimitManager) stat() []Map {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	result := []Map{}
+	for _, limiter := range manager.limiters {
+		scope := limiter.scope
+		if len(scope) == 0 {
+			scope = "global"
+		}
+
+		algorithm := limiter.Config.Algorithm
+		if len(algorithm) == 0 {
+			algorithm = RATE_LIMIT_TOKEN_BUCKET
+		}
+
+		key := strings.Join(limiter.keys, ",")
+		if len(key) == 0 {
+			key = "global"
+		}
+
+		limiter.mutex.Lock()
+		result = append(result, Map{
+			"id":        limiter.id,
+			"scope":     scope,
+			"algorithm": algorithm,
+			"key":       key,
+			"period":    limiter.Config.Period,
+			"keys":      len(limiter.buckets),
+			"allowed":   limiter.allowed,
+			"rejected":  limiter.rejected,
+		})
+		limiter.mutex.Unlock()
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["id"].(string) < result[j]["id"].(string)
+	})
+
+	return result
+}
+
+// 输出限流头部
+func (manager *RateLimitManager) writeHeaders(writer http.ResponseWriter, result RateLimitResult) {
+	writer.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	writer.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	writer.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(result.Reset.Seconds())), 10))
+}
+
+// 创建限流器
+func newRateLimiter(scope string, config RateLimitConfig) (limiter *RateLimiter, err error) {
+	if config.Requests <= 0 {
+		err = errors.New("'requests' should be greater than 0")
+		return
+	}
+
+	if len(config.Algorithm) == 0 {
+		config.Algorithm = RATE_LIMIT_TOKEN_BUCKET
+	}
+	if config.Algorithm != RATE_LIMIT_TOKEN_BUCKET && config.Algorithm != RATE_LIMIT_SLIDING_WINDOW && config.Algorithm != RATE_LIMIT_QUOTA {
+		err = errors.New("invalid algorithm '" + config.Algorithm + "'")
+		return
+	}
+
+	var period time.Duration
+	if config.Algorithm == RATE_LIMIT_QUOTA {
+		// 配额按照自然日和自然月计数，这里的周期只用来清理空闲的计数
+		switch config.Period {
+		case "day":
+			period = 24 * time.Hour
+		case "month":
+			period = 31 * 24 * time.Hour
+		default:
+			err = errors.New("invalid quota period '" + config.Period + "', should be 'day' or 'month'")
+			return
+		}
+	} else {
+		period, err = parsePeriodFromString(config.Period)
+		if err != nil {
+			return
+		}
+		if period <= 0 {
+			period = time.Minute
+		}
+	}
+
+	keys := []string{}
+	for _, key := range strings.Split(config.Key, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 0 {
+			continue
+		}
+		if key != "global" && key != "api" && key != "client" && key != "consumer" && !strings.HasPrefix(key, "header:") {
+			err = errors.New("invalid key '" + key + "'")
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	capacity := float64(config.Requests)
+	if config.Burst > 0 {
+		capacity = float64(config.Burst)
+	}
+
+	limiter = &RateLimiter{
+		Config:     config,
+		persistent: config.Algorithm == RATE_LIMIT_QUOTA || period >= time.Hour,
+		scope:      scope,
+		keys:       keys,
+		period:     period,
+		capacity:   capacity,
+		rate:       float64(config.Requests) / float64(period),
+		buckets:    map[string]*rateLimitBucket{},
+	}
+	return
+}
+
+// 构造计数用的键
+func (limiter *RateLimiter) buildKey(request *http.Request, api *Api) string {
+	pieces := []string{limiter.scope}
+	for _, key := range limiter.keys {
+		switch key {
+		case "global":
+		case "api":
+			pieces = append(pieces, api.Path)
+		case "client":
+			ip := parseRemoteIP(request.RemoteAddr)
+			if ip != nil {
+				pieces = append(pieces, ip.String())
+			} else {
+				pieces = append(pieces, request.RemoteAddr)
+			}
+		case "consumer":
+			pieces = append(pieces, appManager.findConsumer(request))
+		default:
+			pieces = append(pieces, request.Header.Get(strings.TrimPrefix(key, "header:")))
+		}
+	}
+	return strings.Join(pieces, "$$")
+}
+
+// 消耗一次请求，允许的请求在所有限流器都允许后再通过countAllowed()计数
+func (limiter *RateLimiter) take(key string, now int64) (result RateLimitResult) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{
+			tokens:      limiter.capacity,
+			windowStart: now - now%int64(limiter.period),
+			updatedAt:   now,
+		}
+		limiter.buckets[key] = bucket
+	}
+	bucket.isChanged = true
+
+	switch limiter.Config.Algorithm {
+	case RATE_LIMIT_SLIDING_WINDOW:
+		result = limiter.takeWindow(bucket, now)
+	case RATE_LIMIT_QUOTA:
+		result = limiter.takeQuota(bucket, now)
+	default:
+		result = limiter.takeToken(bucket, now)
+	}
+
+	if !result.Allowed {
+		limiter.rejected++
+	}
+	return
+}
+
+// 归还一次已经消耗的请求
+func (limiter *RateLimiter) refund(key string, result RateLimitResult) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	bucket, ok := limiter.buckets[key]
+	if !ok || !result.Allowed {
+		return
+	}
+
+	switch limiter.Config.Algorithm {
+	case RATE_LIMIT_SLIDING_WINDOW, RATE_LIMIT_QUOTA:
+		// 已经进入下一个窗口时不需要归还
+		if bucket.windowStart == result.windowStart && bucket.current > 0 {
+			bucket.current--
+		}
+	default:
+		bucket.tokens = math.Min(limiter.capacity, bucket.tokens+1)
+	}
+	bucket.isChanged = true
+}
+
+// 计数允许的请求
+func (limiter *RateLimiter) countAllowed() {
+	limiter.mutex.Lock()
+	limiter.allowed++
+	limiter.mutex.Unlock()
+}
+
+// 令牌桶算法
+func (limiter *RateLimiter) takeToken(bucket *rateLimitBucket, now int64) (result RateLimitResult) {
+	bucket.tokens = math.Min(limiter.capacity, bucket.tokens+float64(now-bucket.updatedAt)*limiter.rate)
+	bucket.updatedAt = now
+
+	result.Limit = int(limiter.capacity)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / limiter.rate)
+	}
+
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((limiter.capacity - bucket.tokens) / limiter.rate)
+	return
+}
+
+// 滑动窗口算法，使用上一个窗口的加权计数估算当前窗口的请求数
+func (limiter *RateLimiter) takeWindow(bucket *rateLimitBucket, now int64) (result RateLimitResult) {
+	period := int64(limiter.period)
+	windowStart := now - now%period
+	if windowStart != bucket.windowStart {
+		if windowStart-bucket.windowStart == period {
+			bucket.previous = bucket.current
+		} else {
+			bucket.previous = 0
+		}
+		bucket.current = 0
+		bucket.windowStart = windowStart
+	}
+	bucket.updatedAt = now
+
+	limit := limiter.Config.Requests
+	elapsed := float64(now-windowStart) / float64(period)
+	estimate := float64(bucket.previous)*(1-elapsed) + float64(bucket.current)
+
+	result.Limit = limit
+	result.Reset = time.Duration(period - (now - windowStart))
+	result.windowStart = windowStart
+
+	if estimate+1 <= float64(limit) {
+		bucket.current++
+		result.Allowed = true
+		result.Remaining = int(float64(limit) - estimate - 1)
+		return
+	}
+
+	// 计算还要等多久
+	if bucket.current+1 <= limit {
+		wait := float64(period)*(1-float64(limit-bucket.current-1)/float64(bucket.previous)) - float64(now-windowStart)
+		result.RetryAfter = time.Duration(math.Max(wait, 0))
+	} else {
+		wait := float64(period) * (1 - float64(limit-1)/float64(bucket.current))
+		result.RetryAfter = result.Reset + time.Duration(math.Max(wait, 0))
+	}
+	return
+}
+
+// 配额算法，按照自然日或者自然月计数
+func (limiter *RateLimiter) takeQuota(bucket *rateLimitBucket, now int64) (result RateLimitResult) {
+	t := time.Unix(0, now)
+	var start time.Time
+	var end time.Time
+	if limiter.Config.Period == "month" {
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+		end = start.AddDate(0, 1, 0)
+	} else {
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+		end = start.AddDate(0, 0, 1)
+	}
+
+	if bucket.windowStart != start.UnixNano() {
+		bucket.windowStart = start.UnixNano()
+		bucket.current = 0
+	}
+	bucket.updatedAt = now
+
+	result.Limit = limiter.Config.Requests
+	result.Reset = end.Sub(t)
+	result.windowStart = bucket.windowStart
+
+	if bucket.current < result.Limit {
+		bucket.current++
+		result.Allowed = true
+	} else {
+		result.RetryAfter = result.Reset
+	}
+
+	result.Remaining = result.Limit - bucket.current
+	return
+}
+
+// 取得有改变的计数，同时清除改变标记
+func (limiter *RateLimiter) changedBuckets() (counters map[string]StatRateLimit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	counters = map[string]StatRateLimit{}
+	for key, bucket := range limiter.buckets {
+		if bucket.isChanged {
+			bucket.isChanged = false
+			counters[key] = StatRateLimit{
+				Tokens:      bucket.tokens,
+				WindowStart: bucket.windowStart,
+				Current:     bucket.current,
+				Previous:    bucket.previous,
+				UpdatedAt:   bucket.updatedAt,
+			}
+		}
+	}
+	return
+}
+
+// 清理空闲的计数，返回清理的键
+func (limiter *RateLimiter) clearIdle(now int64) (keys []string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	idle := 2 * int64(limiter.period)
+	for key, bucket := range limiter.buckets {
+		if now-bucket.updatedAt > idle {
+			delete(limiter.buckets, key)
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// 分析周期，在time.ParseDuration基础上支持d（天）
+func parsePeriodFromString(period string) (time.Duration, error) {
+	period = strings.TrimSpace(period)
+	if len(period) == 0 {
+		return 0, nil
+	}
+
+	if strings.HasSuffix(period, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(period, "d"), 64)
+		if err != nil {
+			return 0, errors.New("invalid period '" + period + "'")
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	duration, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, errors.New("invalid period '" + period + "'")
+	}
+	return duration, nil
+}
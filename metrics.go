@@ -0,0 +1,284 @@
+package MeloyApi
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 请求耗时直方图的边界，单位为秒
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 监控指标管理器
+// 以Prometheus文本格式输出请求计数、耗时直方图，以及缓存、限流、并发和运行时的指标
+type MetricsManager struct {
+	requests map[metricsRequestLabels]*metricsRequestData
+	mutex    sync.Mutex
+}
+
+// 请求指标的标签
+type metricsRequestLabels struct {
+	api         string
+	server      string
+	host        string
+	method      string
+	statusClass string
+}
+
+// 请求指标
+type metricsRequestData struct {
+	count   int64
+	sum     float64
+	buckets []int64 // 每个边界内的请求数，不累加
+}
+
+var metricsManager = MetricsManager{
+	requests: map[metricsRequestLabels]*metricsRequestData{},
+}
+
+// 记录一次请求
+func (manager *MetricsManager) observe(api string, server string, host string, method string, statusCode int, duration time.Duration) {
+	labels := metricsRequestLabels{
+		api:         api,
+		server:      server,
+		host:        host,
+		method:      method,
+		statusClass: strconv.Itoa(statusCode/100) + "xx",
+	}
+	seconds := duration.Seconds()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	data, ok := manager.requests[labels]
+	if !ok {
+		data = &metricsRequestData{
+			buckets: make([]int64, len(metricsLatencyBuckets)),
+		}
+		manager.requests[labels] = data
+	}
+
+	data.count++
+	data.sum += seconds
+	for index, bound := range metricsLatencyBuckets {
+		if seconds <= bound {
+			data.buckets[index]++
+			break
+		}
+	}
+}
+
+// 输出所有指标
+func (manager *MetricsManager) write(writer io.Writer) {
+	manager.writeRequests(writer)
+	manager.writeCache(writer)
+	manager.writeRateLimits(writer)
+	manager.writeConcurrency(writer)
+	manager.writeRuntime(writer)
+}
+
+// 输出请求指标
+func (manager *MetricsManager) writeRequests(writer io.Writer) {
+	manager.mutex.Lock()
+	labelsList := []metricsRequestLabels{}
+	dataList := map[metricsRequestLabels]metricsRequestData{}
+	for labels, data := range manager.requests {
+		labelsList = append(labelsList, labels)
+		dataList[labels] = metricsRequestData{
+			count:   data.count,
+			sum:     data.sum,
+			buckets: append([]int64{}, data.buckets...),
+		}
+	}
+	manager.mutex.Unlock()
+
+	sort.Slice(labelsList, func(i, j int) bool {
+		return labelsList[i].String() < labelsList[j].String()
+	})
+
+	writeMetricsHeader(writer, "meloy_requests_total", "counter", "Total number of requests handled by the gateway.")
+	for _, labels := range labelsList {
+		fmt.Fprintf(writer, "meloy_requests_total{%s} %d\n", labels.String(), dataList[labels].count)
+	}
+
+	writeMetricsHeader(writer, "meloy_request_duration_seconds", "histogram", "Request latency in seconds.")
+	for _, labels := range labelsList {
+		data := dataList[labels]
+		var cumulative int64
+		for index, bound := range metricsLatencyBuckets {
+			cumulative += data.buckets[index]
+			fmt.Fprintf(writer, "meloy_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels.String(), formatMetricsFloat(bound), cumulative)
+		}
+		fmt.Fprintf(writer, "meloy_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels.String(), data.count)
+		fmt.Fprintf(writer, "meloy_request_duration_seconds_sum{%s} %s\n", labels.String(), formatMetricsFloat(data.sum))
+		fmt.Fprintf(writer, "meloy_request_duration_seconds_count{%s} %d\n", labels.String(), data.count)
+	}
+}
+
+// 输出缓存指标
+func (manager *MetricsManager) writeCache(writer io.Writer) {
+	stat := cacheManager.stat()
+
+	gauges := []struct {
+		name  string
+		field string
+		help  string
+	}{
+		{"meloy_cache_entries", "entries", "Number of entries in the memory cache."},
+		{"meloy_cache_bytes", "bytes", "Bytes used by the memory cache."},
+		{"meloy_cache_max_bytes", "maxBytes", "Maximum bytes of the memory cache."},
+	}
+	for _, gauge := range gauges {
+		writeMetricsHeader(writer, gauge.name, "gauge", gauge.help)
+		fmt.Fprintf(writer, "%s %v\n", gauge.name, stat[gauge.field])
+	}
+
+	counters := []struct {
+		name  string
+		field string
+		help  string
+	}{
+		{"meloy_cache_hits_total", "hits", "Number of memory cache hits."},
+		{"meloy_cache_misses_total", "misses", "Number of memory cache misses."},
+		{"meloy_cache_sets_total", "sets", "Number of memory cache writes."},
+		{"meloy_cache_evictions_total", "evictions", "Number of entries evicted from the memory cache."},
+		{"meloy_cache_expires_total", "expires", "Number of expired entries removed from the memory cache."},
+		{"meloy_cache_stales_total", "stales", "Number of lookups that found an expired but retained entry."},
+	}
+	for _, counter := range counters {
+		writeMetricsHeader(writer, counter.name, "counter", counter.help)
+		fmt.Fprintf(writer, "%s %v\n", counter.name, stat[counter.field])
+	}
+
+	diskStat, ok := stat["disk"].(Map)
+	if !ok {
+		return
+	}
+
+	diskMetrics := []struct {
+		name       string
+		metricType string
+		field      string
+		help       string
+	}{
+		{"meloy_cache_disk_entries", "gauge", "entries", "Number of entries in the disk cache."},
+		{"meloy_cache_disk_bytes", "gauge", "bytes", "Bytes used by the disk cache."},
+		{"meloy_cache_disk_max_bytes", "gauge", "maxBytes", "Maximum bytes of the disk cache."},
+		{"meloy_cache_disk_hits_total", "counter", "hits", "Number of entries read from the disk cache."},
+		{"meloy_cache_disk_writes_total", "counter", "writes", "Number of entries written to the disk cache."},
+		{"meloy_cache_disk_evictions_total", "counter", "evictions", "Number of entries evicted from the disk cache."},
+		{"meloy_cache_disk_drops_total", "counter", "drops", "Number of disk cache writes dropped because the queue was full."},
+	}
+	for _, metric := range diskMetrics {
+		writeMetricsHeader(writer, metric.name, metric.metricType, metric.help)
+		fmt.Fprintf(writer, "%s %v\n", metric.name, diskStat[metric.field])
+	}
+}
+
+// 输出限流指标
+func (manager *MetricsManager) writeRateLimits(writer io.Writer) {
+	limiters := rateLimitManager.stat()
+
+	writeMetricsHeader(writer, "meloy_rate_limit_requests_total", "counter", "Requests checked by rate limiters.")
+	for _, limiter := range limiters {
+		labels := formatMetricsLabels("limiter", limiter["id"].(string), "scope", limiter["scope"].(string), "algorithm", limiter["algorithm"].(string), "key", limiter["key"].(string), "period", limiter["period"].(string))
+		fmt.Fprintf(writer, "meloy_rate_limit_requests_total{%s,result=\"allowed\"} %d\n", labels, limiter["allowed"])
+		fmt.Fprintf(writer, "meloy_rate_limit_requests_total{%s,result=\"rejected\"} %d\n", labels, limiter["rejected"])
+	}
+
+	writeMetricsHeader(writer, "meloy_rate_limit_keys", "gauge", "Number of keys tracked by rate limiters.")
+	for _, limiter := range limiters {
+		labels := formatMetricsLabels("limiter", limiter["id"].(string), "scope", limiter["scope"].(string), "algorithm", limiter["algorithm"].(string), "key", limiter["key"].(string), "period", limiter["period"].(string))
+		fmt.Fprintf(writer, "meloy_rate_limit_keys{%s} %d\n", labels, limiter["keys"])
+	}
+}
+
+// 输出并发指标
+func (manager *MetricsManager) writeConcurrency(writer io.Writer) {
+	limiters, inFlight, queued := concurrencyManager.stat()
+
+	writeMetricsHeader(writer, "meloy_in_flight_requests", "gauge", "Number of requests being forwarded to API servers.")
+	fmt.Fprintf(writer, "meloy_in_flight_requests %d\n", inFlight)
+
+	writeMetricsHeader(writer, "meloy_queued_requests", "gauge", "Number of requests waiting for a concurrency slot.")
+	fmt.Fprintf(writer, "meloy_queued_requests %d\n", queued)
+
+	writeMetricsHeader(writer, "meloy_concurrency_in_flight", "gauge", "Number of in-flight requests per concurrency limiter.")
+	for _, limiter := range limiters {
+		fmt.Fprintf(writer, "meloy_concurrency_in_flight{%s} %d\n", formatMetricsLabels("limiter", limiter["name"].(string)), limiter["inFlight"])
+	}
+
+	writeMetricsHeader(writer, "meloy_concurrency_queued", "gauge", "Number of queued requests per concurrency limiter.")
+	for _, limiter := range limiters {
+		fmt.Fprintf(writer, "meloy_concurrency_queued{%s} %d\n", formatMetricsLabels("limiter", limiter["name"].(string)), limiter["queued"])
+	}
+
+	writeMetricsHeader(writer, "meloy_concurrency_rejected_total", "counter", "Number of requests rejected per concurrency limiter.")
+	for _, limiter := range limiters {
+		fmt.Fprintf(writer, "meloy_concurrency_rejected_total{%s} %d\n", formatMetricsLabels("limiter", limiter["name"].(string)), limiter["rejected"])
+	}
+}
+
+// 输出运行时指标
+func (manager *MetricsManager) writeRuntime(writer io.Writer) {
+	memoryStat := runtime.MemStats{}
+	runtime.ReadMemStats(&memoryStat)
+
+	writeMetricsHeader(writer, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(writer, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	writeMetricsHeader(writer, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	fmt.Fprintf(writer, "go_memstats_sys_bytes %d\n", memoryStat.Sys)
+
+	writeMetricsHeader(writer, "go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.")
+	fmt.Fprintf(writer, "go_memstats_heap_alloc_bytes %d\n", memoryStat.HeapAlloc)
+
+	writeMetricsHeader(writer, "go_memstats_heap_sys_bytes", "gauge", "Number of heap bytes obtained from system.")
+	fmt.Fprintf(writer, "go_memstats_heap_sys_bytes %d\n", memoryStat.HeapSys)
+
+	writeMetricsHeader(writer, "go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	fmt.Fprintf(writer, "go_memstats_heap_objects %d\n", memoryStat.HeapObjects)
+
+	writeMetricsHeader(writer, "go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	fmt.Fprintf(writer, "go_gc_cycles_total %d\n", memoryStat.NumGC)
+
+	writeMetricsHeader(writer, "go_gc_pause_seconds_total", "counter", "Total GC pause time in seconds.")
+	fmt.Fprintf(writer, "go_gc_pause_seconds_total %s\n", formatMetricsFloat(float64(memoryStat.PauseTotalNs)/1e9))
+}
+
+// 标签字符串
+func (labels metricsRequestLabels) String() string {
+	return formatMetricsLabels("api", labels.api, "server", labels.server, "host", labels.host, "method", labels.method, "status", labels.statusClass)
+}
+
+// 输出指标的说明和类型
+func writeMetricsHeader(writer io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// 格式化标签，参数为 name1, value1, name2, value2, ...
+func formatMetricsLabels(pairs ...string) string {
+	pieces := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		pieces = append(pieces, pairs[i]+"=\""+escapeMetricsLabel(pairs[i+1])+"\"")
+	}
+	return strings.Join(pieces, ",")
+}
+
+// 转义标签值中的反斜杠、双引号和换行
+func escapeMetricsLabel(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	value = strings.Replace(value, "\n", "\\n", -1)
+	return value
+}
+
+// 格式化浮点数
+func formatMetricsFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
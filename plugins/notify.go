@@ -0,0 +1,105 @@
+package plugins
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// 通知方式，可以执行命令或者调用URL
+type NotifyConfig struct {
+	Command string
+	URL     string
+
+	Commands []string
+	URLs     []string
+}
+
+// 通知内容
+type NotifyMessage struct {
+	Env  []string // 执行命令时附加的环境变量，格式为 NAME=VALUE
+	Body []byte   // 调用URL时发送的JSON内容，为空时使用GET调用
+}
+
+var notifyClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// 是否没有设置任何通知方式
+func (config NotifyConfig) IsEmpty() bool {
+	return len(config.Command) == 0 && len(config.URL) == 0 && len(config.Commands) == 0 && len(config.URLs) == 0
+}
+
+// 发送通知，logPrefix为日志前缀
+func (config NotifyConfig) Notify(logPrefix string, message NotifyMessage) {
+	// 执行命令
+	var cmds = config.Commands
+	if len(config.Command) > 0 {
+		cmds = append(append([]string{}, cmds...), config.Command)
+	}
+
+	for _, command := range cmds {
+		go func(command string) {
+			log.Println(logPrefix+": Start", command)
+			var cmd = exec.Command("sh", "-c", command)
+			if len(message.Env) > 0 {
+				cmd.Env = append(os.Environ(), message.Env...)
+			}
+
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				log.Println(logPrefix+":", err.Error())
+				return
+			}
+
+			err = cmd.Start()
+			if err != nil {
+				log.Println(logPrefix+":", err.Error())
+				stdout.Close()
+				return
+			}
+
+			_bytes, err := ioutil.ReadAll(stdout)
+			stdout.Close()
+			cmd.Wait()
+			if err != nil {
+				log.Println(logPrefix+":", err.Error())
+				return
+			}
+
+			log.Println(logPrefix+":", strings.Trim(string(_bytes), " \t\n"))
+		}(command)
+	}
+
+	//调用URL
+	var urls = config.URLs
+	if len(config.URL) > 0 {
+		urls = append(append([]string{}, urls...), config.URL)
+	}
+
+	for _, url := range urls {
+		go func(url string) {
+			var resp *http.Response
+			var err error
+			if len(message.Body) > 0 {
+				resp, err = notifyClient.Post(url, "application/json", bytes.NewReader(message.Body))
+			} else {
+				resp, err = notifyClient.Get(url)
+			}
+			if err != nil {
+				log.Println(logPrefix+":", err.Error())
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			log.Println(logPrefix+": Notify", url)
+		}(url)
+	}
+}
@@ -6,9 +6,6 @@ import (
 	"encoding/json"
 	"time"
 	"os"
-	"os/exec"
-	"net/http"
-	"strings"
 	"regexp"
 )
 
@@ -23,13 +20,7 @@ type WatchConfig struct {
 
 type WatchFileConfig struct {
 	File string `json:"file"`
-	Notify struct {
-		Command string
-		URL string
-
-		Commands []string
-		URLs []string
-	} `json:"notify"`
+	Notify NotifyConfig `json:"notify"`
 
 	exists     bool
 	modifiedAt int64
@@ -101,65 +92,5 @@ func (plugin *WatchPlugin) StopFunc() {
 
 // 发送通知
 func notifyFile(file WatchFileConfig) {
-	// 执行命令
-	var cmds = file.Notify.Commands
-	if len(file.Notify.Command) > 0 {
-		cmds = append(cmds, file.Notify.Command)
-	}
-
-	if len(cmds) > 0 {
-		for _, command := range cmds {
-			func(command string) {
-				go func() {
-					log.Println("Watch Log: Start", command)
-					var cmd = exec.Command("sh", "-c", command)
-
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						log.Println("Watch Log:", err.Error())
-						return
-					}
-
-					err = cmd.Start()
-
-					if err != nil {
-						log.Println("Watch Log:", err.Error())
-						stdout.Close()
-						cmd.Wait()
-						return
-					}
-
-					_bytes, err := ioutil.ReadAll(stdout)
-					if err != nil {
-						log.Println("Watch Log:", err.Error())
-						stdout.Close()
-						cmd.Wait()
-						return
-					}
-
-					stdout.Close()
-
-					cmd.Wait()
-					log.Println("Watch Log:", strings.Trim(string(_bytes), " \t\n"))
-				}()
-			}(command)
-		}
-	}
-
-	//调用URL
-	var urls = file.Notify.URLs
-	if len(file.Notify.URL) > 0 {
-		urls = append(urls, file.Notify.URL)
-	}
-
-	if len(urls) > 0 {
-		for _, url := range urls {
-			func(url string) {
-				go func() {
-					http.Get(url)
-					log.Println("Watch Log: Notify", url)
-				}()
-			}(url)
-		}
-	}
+	file.Notify.Notify("Watch Log", NotifyMessage{})
 }
@@ -3,17 +3,14 @@ package MeloyApi
 import (
 	"bytes"
 	"compress/gzip"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -22,18 +19,22 @@ type StatManager struct {
 	Data      map[string]StatData
 	DebugLogs []DebugLog
 
-	db *sql.DB
+	store StatStore
 }
 
 type StatData struct {
-	Server string
-	Host   string
-	Path   string
+	Server   string
+	Host     string
+	Path     string
+	Consumer string
 
 	TotalMs  int64
 	Requests int64
 	Errors   int64
 	Hits     int64
+
+	Histogram   StatHistogram
+	StatusCodes StatStatusCodes
 }
 
 type DebugLog struct {
@@ -47,12 +48,17 @@ type DebugLog struct {
 }
 
 type ApiMinuteStat struct {
-	Hour     int `json:"hour"`
-	Minute   int `json:"minute"`
-	Requests int `json:"requests"`
-	Errors   int `json:"errors"`
-	Hits     int `json:"hits"`
-	AvgMs    int `json:"avgMs"`
+	Server   string `json:"server"`
+	Host     string `json:"host"`
+	Hour     int    `json:"hour"`
+	Minute   int    `json:"minute"`
+	Requests int    `json:"requests"`
+	Errors   int    `json:"errors"`
+	Hits     int    `json:"hits"`
+	AvgMs    int    `json:"avgMs"`
+
+	StatPercentiles
+	Statuses StatStatuses `json:"statuses"`
 }
 
 type ApiStat struct {
@@ -60,6 +66,9 @@ type ApiStat struct {
 	Requests int `json:"requests"`
 	Hits     int `json:"hits"`
 	Errors   int `json:"errors"`
+
+	StatPercentiles
+	Statuses StatStatuses `json:"statuses"`
 }
 
 type ApiWatchLog struct {
@@ -79,7 +88,6 @@ type ApiWatchLog struct {
 	} `json:"response"`
 }
 
-var lastTableDay string = ""
 var statMu sync.Mutex
 var statWatchLogs = []ApiWatchLog{}
 
@@ -90,15 +98,16 @@ func (manager *StatManager) init(appDir string) {
 	manager.Data = map[string]StatData{}
 	manager.DebugLogs = []DebugLog{}
 
-	//启动数据库
-	db, err := sql.Open("sqlite3", appDir+"/data/stat.db")
+	//打开存储
+	store, err := newStatStore(appConfig.Stat.Store)
 	if err != nil {
-		log.Fatal("Can not open database at '"+appDir+"/data/stat.db"+"':", err.Error())
+		log.Fatal("Can not open stat store:", err.Error())
 	}
-	manager.db = db
-
-	// 准备数据库表
-	manager.prepareDailyTable()
+	err = store.open(appDir + "/data")
+	if err != nil {
+		log.Fatal("Can not open stat store at '"+appDir+"/data"+"':", err.Error())
+	}
+	manager.store = store
 
 	//启动定时器，每分钟导出数据到本地
 	go func() {
@@ -106,96 +115,35 @@ func (manager *StatManager) init(appDir string) {
 		for {
 			<-tick
 
-			if manager.prepareDailyTable() {
-				manager.dump()
-			}
-		}
-	}()
-}
-
-// 准备每天的数据表格
-func (manager *StatManager) prepareDailyTable() bool {
-	now := time.Now()
-	date := fmt.Sprintf("%d%02d%02d", now.Year(), int(now.Month()), now.Day())
-
-	if lastTableDay == date {
-		return true
-	}
-
-	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS stat_%{date} (
-		id integer not null primary key autoincrement,
-		server text,
-		host text,
-		path text,
-		ms integer,
-		year integer,
-		month integer,
-		day integer,
-		hour integer,
-		minute integer,
-		requests integer,
-		errors integer,
-		hits integer
-	);
-	CREATE INDEX IF NOT EXISTS server ON stat_%{date} (server);
-	CREATE INDEX IF NOT EXISTS host ON stat_%{date} (host);
-	CREATE INDEX IF NOT EXISTS path_index ON stat_%{date} (path);
-	CREATE INDEX IF NOT EXISTS date_minute_index ON stat_%{date} (path, year, month, day, hour, minute);
-	CREATE INDEX IF NOT EXISTS date_day_index ON stat_%{date} (path, year, month, day);
-
-
-	CREATE TABLE IF NOT EXISTS debug_logs_%{date} (
-		id integer not null primary key autoincrement,
-		server text,
-		host text,
-		path text,
-		uri text,
-		body string,
-		created_at integer
-	);
-	CREATE INDEX IF NOT EXISTS path_index ON debug_logs_%{date} (path);
-
-
-	CREATE TABLE IF NOT EXISTS stat_global (
-		id integer not null primary key autoincrement,
-		requests integer,
-		hits integer,
-		errors integer,
-		created_at integer
-	);
-	`
-
-	sqlStmt = strings.Replace(sqlStmt, "%{date}", date, -1)
-
-	log.Println("create table for date '" + date + "'")
-
-	_, err := manager.db.Exec(sqlStmt)
-	if err != nil {
-		log.Println("error:" + err.Error())
-		return false
-	}
+			manager.dump()
 
-	lastTableDay = date
+			// 检查告警规则
+			alertManager.evaluate(time.Now())
 
-	return true
+			// 汇总和清理历史数据
+			manager.compactIfNeeded()
+		}
+	}()
 }
 
-// 发送统计信息
-func (manager *StatManager) send(address ApiAddress, path string, uri string, timeMs int64, errors int64, hits int64) {
+// 发送统计信息，statusCode为API服务器或者缓存的响应状态码，为0表示网关自身出错
+func (manager *StatManager) send(address ApiAddress, path string, consumer string, uri string, timeMs int64, statusCode int, errors int64, hits int64) {
 	statMu.Lock()
 
-	key := address.Server + "$$" + address.Host + "$$" + path
+	key := address.Server + "$$" + address.Host + "$$" + path + "$$" + consumer
 	value, ok := manager.Data[key]
 	if !ok {
 		value = StatData{
 			address.Server,
 			address.Host,
 			path,
+			consumer,
 			timeMs,
 			1,
 			errors,
 			hits,
+			newStatHistogram(),
+			StatStatusCodes{},
 		}
 	} else {
 		value.TotalMs += timeMs
@@ -203,6 +151,8 @@ func (manager *StatManager) send(address ApiAddress, path string, uri string, ti
 		value.Errors += errors
 		value.Hits += hits
 	}
+	value.Histogram.add(timeMs)
+	value.StatusCodes.add(statusCode)
 
 	manager.Data[key] = value
 	statMu.Unlock()
@@ -211,8 +161,10 @@ func (manager *StatManager) send(address ApiAddress, path string, uri string, ti
 		_bytes, err := json.MarshalIndent(Map{
 			"Api":       path,
 			"Address":   address.URL,
+			"Consumer":  consumer,
 			"URI":       uri,
 			"TimeMs":    timeMs,
+			"Status":    statusCode,
 			"HasErrors": errors > 0,
 			"HitCache":  hits > 0,
 		}, "", "    ")
@@ -224,6 +176,16 @@ func (manager *StatManager) send(address ApiAddress, path string, uri string, ti
 	}
 }
 
+// 合并另外一份统计数据
+func (data *StatData) merge(other StatData) {
+	data.TotalMs += other.TotalMs
+	data.Requests += other.Requests
+	data.Errors += other.Errors
+	data.Hits += other.Hits
+	data.Histogram.merge(other.Histogram)
+	data.StatusCodes.merge(other.StatusCodes)
+}
+
 // 发送调试信息
 func (manager *StatManager) sendDebug(address ApiAddress, path string, uri string, _log string) {
 	manager.DebugLogs = append(manager.DebugLogs, DebugLog{
@@ -330,69 +292,52 @@ func (manager *StatManager) drainBody(b io.ReadCloser) (r1, r2 io.ReadCloser, er
 	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
 }
 
-// 导出数据到数据库
+// 导出数据到存储
 func (manager *StatManager) dump() {
+	statMu.Lock()
 	data := manager.Data
 
 	//清空
 	manager.Data = map[string]StatData{}
+	statMu.Unlock()
 
 	//导数据
-	stmt, err := manager.db.Prepare("INSERT INTO stat_" + lastTableDay + " (server,host,path,ms, year,month,day,hour, minute,requests,errors,hits) VALUES (?,?,?,?, ?,?,?,?, ?,?,?,?)")
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	defer stmt.Close()
-
-	//当日统计
 	now := time.Now()
+	rows := []StatRow{}
 	for _, statData := range data {
-		_, err := stmt.Exec(statData.Server, statData.Host, statData.Path, statData.TotalMs/statData.Requests, now.Year(), int(now.Month()), now.Day(), now.Hour(), now.Minute(), statData.Requests, statData.Errors, statData.Hits)
-		if err != nil {
-			log.Println("Error:" + err.Error())
-			continue
-		}
+		rows = append(rows, StatRow{
+			StatData: statData,
+			Time:     truncateStatTime(now, STAT_GRANULARITY_MINUTE),
+		})
+	}
+
+	err := manager.store.writeRows(STAT_GRANULARITY_MINUTE, formatStatDate(now), rows)
+	if err != nil {
+		log.Println("Error:" + err.Error())
 	}
 
 	//总体统计
-	statManager.updateGlobalStat(data)
+	manager.updateGlobalStat(data)
 
 	//导日志
-	statManager.flushDebugLogs()
+	manager.flushDebugLogs()
 }
 
 // 更新全局统计
 func (manager *StatManager) updateGlobalStat(data map[string]StatData) {
-	//总体统计
-	globalStmt, err := manager.db.Prepare("SELECT id FROM stat_global LIMIT 1")
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	defer globalStmt.Close()
-
-	row := globalStmt.QueryRow()
-	var id int
-	err = row.Scan(&id)
-	if err != nil {
-		manager.db.Exec("INSERT INTO stat_global (requests, hits, errors, created_at) VALUES (?, ?, ?, ?)", 0, 0, 0, time.Now().Unix())
-	}
-
-	requests := 0
-	hits := 0
-	errors := 0
+	var requests int64 = 0
+	var hits int64 = 0
+	var errors int64 = 0
 
 	for _, stat := range data {
-		requests += int(stat.Requests)
-		hits += int(stat.Hits)
-		errors += int(stat.Errors)
+		requests += stat.Requests
+		hits += stat.Hits
+		errors += stat.Errors
 	}
 
-	if requests > 0 || hits > 0 || errors > 0 {
-		manager.db.Exec("UPDATE stat_global SET requests=requests+?,hits=hits+?,errors=errors+?", requests, hits, errors)
+	err := manager.store.addGlobalStat(requests, hits, errors)
+	if err != nil {
+		log.Println("Error:" + err.Error())
 	}
 }
 
@@ -405,72 +350,70 @@ func (manager *StatManager) avgStat(path string) ApiStat {
 // 取得某一天的总统计
 func (manager *StatManager) findAvgStatForDay(path string, year int, month int, day int) ApiStat {
 	date := fmt.Sprintf("%d%02d%02d", year, month, day)
-	stmt, err := manager.db.Prepare("SELECT SUM(ms),SUM(requests),SUM(hits),SUM(errors) FROM stat_" + date + " WHERE path=?")
-	if err != nil {
-		log.Println("Error:" + err.Error())
+	rows, _ := manager.findStatRows(date, path)
+	if len(rows) == 0 {
 		return ApiStat{AvgMs: 0, Requests: 0, Hits: 0, Errors: 0}
 	}
 
-	defer stmt.Close()
-
-	row := stmt.QueryRow(path)
-	var totalMs int
-	var requests int
-	var hits int
-	var errors int
-	err = row.Scan(&totalMs, &requests, &hits, &errors)
-
-	if err != nil {
-		//log.Println("Error:" + err.Error())
-		return ApiStat{AvgMs: 0, Requests: 0, Hits: 0, Errors: 0}
+	total := StatData{
+		Histogram:   newStatHistogram(),
+		StatusCodes: StatStatusCodes{},
+	}
+	for _, row := range rows {
+		total.merge(row.StatData)
 	}
 
+	avgMs := 0
+	if total.Requests > 0 {
+		avgMs = int(total.TotalMs / total.Requests)
+	}
 	return ApiStat{
-		AvgMs:    totalMs / requests,
-		Requests: requests,
-		Hits:     hits,
-		Errors:   errors,
+		AvgMs:           avgMs,
+		Requests:        int(total.Requests),
+		Hits:            int(total.Hits),
+		Errors:          int(total.Errors),
+		StatPercentiles: total.Histogram.percentiles(),
+		Statuses:        total.StatusCodes.statuses(),
 	}
 }
 
-// 取得某天的分钟统计
-func (manager *StatManager) findMinuteStatForDay(path string, year int, month int, day int) (stats []ApiMinuteStat) {
-	stats = []ApiMinuteStat{}
-
-	date := fmt.Sprintf("%d%02d%02d", year, month, day)
-	stmt, err := manager.db.Prepare("SELECT ms,requests,errors,hits,hour,minute FROM stat_" + date + " WHERE path=? ORDER BY id ASC")
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	defer stmt.Close()
+// 取得某一天某个接口合并后的耗时分布和状态码统计
+func (manager *StatManager) findDistributionForDay(date string, path string) (histogram StatHistogram, statusCodes StatStatusCodes) {
+	histogram = newStatHistogram()
+	statusCodes = StatStatusCodes{}
 
-	rows, err := stmt.Query(path)
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
+	rows, _ := manager.findStatRows(date, path)
+	for _, row := range rows {
+		histogram.merge(row.Histogram)
+		statusCodes.merge(row.StatusCodes)
 	}
 
-	defer rows.Close()
+	return
+}
 
-	for rows.Next() {
-		var ms int
-		var requests int
-		var errors int
-		var hits int
-		var hour int
-		var minute int
+// 取得某天的分钟统计，按分钟的数据已经清理时返回按小时或者按天汇总的数据
+func (manager *StatManager) findMinuteStatForDay(path string, year int, month int, day int) (stats []ApiMinuteStat) {
+	stats = []ApiMinuteStat{}
 
-		rows.Scan(&ms, &requests, &errors, &hits, &hour, &minute)
+	date := fmt.Sprintf("%d%02d%02d", year, month, day)
+	rows, _ := manager.findStatRows(date, path)
+	for _, row := range rows {
+		avgMs := 0
+		if row.Requests > 0 {
+			avgMs = int(row.TotalMs / row.Requests)
+		}
 
 		stats = append(stats, ApiMinuteStat{
-			Hour:     hour,
-			Minute:   minute,
-			AvgMs:    ms,
-			Requests: requests,
-			Errors:   errors,
-			Hits:     hits,
+			Server:          row.Server,
+			Host:            row.Host,
+			Hour:            row.Time.Hour(),
+			Minute:          row.Time.Minute(),
+			AvgMs:           avgMs,
+			Requests:        int(row.Requests),
+			Errors:          int(row.Errors),
+			Hits:            int(row.Hits),
+			StatPercentiles: row.Histogram.percentiles(),
+			Statuses:        row.StatusCodes.statuses(),
 		})
 	}
 
@@ -479,217 +422,67 @@ func (manager *StatManager) findMinuteStatForDay(path string, year int, month in
 
 // 取得某个接口的调试日志
 func (manager *StatManager) findDebugLogsForPath(path string) (logs []DebugLog) {
-	logs = []DebugLog{}
-
-	now := time.Now()
-	date := fmt.Sprintf("%d%02d%02d", now.Year(), int(now.Month()), now.Day())
-
-	stmt, err := manager.db.Prepare("SELECT server, host, path, uri, body, created_at FROM debug_logs_" + date + " WHERE path=? ORDER BY id DESC LIMIT 100")
+	logs, err := manager.store.findDebugLogs(formatStatDate(time.Now()), path, 100)
 	if err != nil {
 		log.Println("Error:" + err.Error())
-		return
 	}
-
-	defer stmt.Close()
-
-	rows, err := stmt.Query(path)
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
+	if logs == nil {
+		logs = []DebugLog{}
 	}
-
-	for rows.Next() {
-		var server string
-		var host string
-		var path string
-		var uri string
-		var body string
-		var createdAt int64
-
-		rows.Scan(&server, &host, &path, &uri, &body, &createdAt)
-
-		logs = append(logs, DebugLog{
-			server,
-			host,
-			path,
-			uri,
-			body,
-			createdAt,
-		})
-	}
-
 	return
 }
 
 // 刷新调试数据
 func (manager *StatManager) flushDebugLogs() (err error, count int) {
-	now := time.Now()
-	date := fmt.Sprintf("%d%02d%02d", now.Year(), int(now.Month()), now.Day())
-
 	statMu.Lock()
 
 	//导日志
 	debugLogs := manager.DebugLogs
 	manager.DebugLogs = []DebugLog{}
 
-	count = len(debugLogs)
-
-	insertDebugStmt, err := manager.db.Prepare("INSERT INTO debug_logs_" + date + " (server, host, path, uri, body, created_at) VALUES (?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		statMu.Unlock()
-		return
-	}
-
-	defer insertDebugStmt.Close()
-
-	for _, debugLog := range debugLogs {
-		_, err := insertDebugStmt.Exec(debugLog.Server, debugLog.Host, debugLog.Path, debugLog.URI, debugLog.Log, debugLog.CreatedAt)
-		if err != nil {
-			log.Println("Error:" + err.Error())
-			continue
-		}
-	}
-
 	statMu.Unlock()
-	return
-}
 
-// 按请求数排序
-func (manager *StatManager) findRequestsRank(size int) (apis []Map, err error) {
-	apis = []Map{}
-	stmt, err := manager.db.Prepare("SELECT path,SUM(requests) AS sum FROM stat_" + lastTableDay + " GROUP BY path ORDER BY sum DESC LIMIT " + strconv.Itoa(size))
-	if err != nil {
-		log.Println("Error:" + err.Error())
+	count = len(debugLogs)
+	if count == 0 {
 		return
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	err = manager.store.writeDebugLogs(formatStatDate(time.Now()), debugLogs)
 	if err != nil {
 		log.Println("Error:" + err.Error())
-		return
 	}
+	return
+}
 
-	for rows.Next() {
-		var path string
-		var sum int
-
-		rows.Scan(&path, &sum)
-
-		apis = append(apis, Map{
-			"path":  path,
-			"count": sum,
-		})
+// 当天的时间范围
+func (manager *StatManager) todayRange() StatRange {
+	from := truncateStatTime(time.Now(), STAT_GRANULARITY_DAY)
+	return StatRange{
+		From:     from,
+		To:       from.AddDate(0, 0, 1),
+		Interval: 24 * time.Hour,
+		Group:    STAT_GROUP_API,
 	}
+}
 
-	return
+// 按请求数排序
+func (manager *StatManager) findRequestsRank(size int) (apis []Map, err error) {
+	return manager.findRangeRank("requests", manager.todayRange(), size, nil), nil
 }
 
 // 按缓存命中数排序
 func (manager *StatManager) findHitsRank(size int) (apis []Map, err error) {
-	apis = []Map{}
-	stmt, err := manager.db.Prepare("SELECT path,AVG(hits * 100/requests) AS sum FROM stat_" + lastTableDay + " WHERE hits>0 GROUP BY path ORDER BY sum DESC LIMIT " + strconv.Itoa(size))
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query()
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	for rows.Next() {
-		var path string
-		var sum float32
-
-		err := rows.Scan(&path, &sum)
-
-		if err != nil {
-			log.Println("Error:" + err.Error())
-			continue
-		}
-
-		apis = append(apis, Map{
-			"path":    path,
-			"percent": sum,
-		})
-	}
-
-	return
+	return manager.findRangeRank("hits", manager.todayRange(), size, nil), nil
 }
 
-// 按错误率排序
-func (manager *StatManager) findErrorsRank(size int) (apis []Map, err error) {
-	apis = []Map{}
-	stmt, err := manager.db.Prepare("SELECT path,AVG(errors * 100/requests) AS sum FROM stat_" + lastTableDay + " WHERE errors>0 GROUP BY path ORDER BY sum DESC LIMIT " + strconv.Itoa(size))
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query()
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	for rows.Next() {
-		var path string
-		var sum float32
-
-		err := rows.Scan(&path, &sum)
-		if err != nil {
-			log.Println("Error:" + err.Error())
-			continue
-		}
-
-		apis = append(apis, Map{
-			"path":    path,
-			"percent": sum,
-		})
-	}
-
-	return
+// 按错误率排序，classes为作为错误统计的状态分类，比如5xx、gateway，为空时使用默认的错误数
+func (manager *StatManager) findErrorsRank(size int, classes []string) (apis []Map, err error) {
+	return manager.findRangeRank("errors", manager.todayRange(), size, classes), nil
 }
 
 // 按照耗时排序
 func (manager *StatManager) findCostRank(size int) (apis []Map, err error) {
-	apis = []Map{}
-	stmt, err := manager.db.Prepare("SELECT path,AVG(ms) AS sum FROM stat_" + lastTableDay + " GROUP BY path ORDER BY sum DESC LIMIT " + strconv.Itoa(size))
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query()
-	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
-	}
-
-	for rows.Next() {
-		var path string
-		var sum float32
-
-		err := rows.Scan(&path, &sum)
-		if err != nil {
-			log.Println("Error:" + err.Error())
-			continue
-		}
-
-		apis = append(apis, Map{
-			"path": path,
-			"ms":   int(sum),
-		})
-	}
-
-	return
+	return manager.findRangeRank("cost", manager.todayRange(), size, nil), nil
 }
 
 // 整体请求频率、命中率、错误率
@@ -700,30 +493,35 @@ func (manager *StatManager) findStat() (result Map, err error) {
 		"errors":   0,
 		"ms":       0,
 	}
-	stmt, err := manager.db.Prepare("SELECT AVG(requests) as requests, SUM(hits) * 100/SUM(requests) AS hits, SUM(errors) * 100/SUM(requests) AS errors, AVG(ms) AS ms FROM stat_" + lastTableDay)
+
+	rows, err := manager.store.findRows(STAT_GRANULARITY_MINUTE, formatStatDate(time.Now()), "")
 	if err != nil {
 		log.Println("Error:" + err.Error())
 		return
 	}
-
-	defer stmt.Close()
-
-	row := stmt.QueryRow()
-	var requests float32
-	var hits float32
-	var errors float32
-	var ms float32
-	err = row.Scan(&requests, &hits, &errors, &ms)
-	if err != nil {
-		//log.Println("Error:" + err.Error())
+	if len(rows) == 0 {
 		return
 	}
 
-	result = Map{
-		"requests": int(requests),
-		"hits":     hits,
-		"errors":   errors,
-		"ms":       int(ms),
+	// 请求数和耗时为每条记录的平均值
+	var requests int64 = 0
+	var hits int64 = 0
+	var errors int64 = 0
+	var ms int64 = 0
+	for _, row := range rows {
+		requests += row.Requests
+		hits += row.Hits
+		errors += row.Errors
+		if row.Requests > 0 {
+			ms += row.TotalMs / row.Requests
+		}
+	}
+
+	result["requests"] = int(requests / int64(len(rows)))
+	result["ms"] = int(ms / int64(len(rows)))
+	if requests > 0 {
+		result["hits"] = float32(hits) * 100 / float32(requests)
+		result["errors"] = float32(errors) * 100 / float32(requests)
 	}
 	return
 }
@@ -737,25 +535,18 @@ func (manager *StatManager) findGlobalStat() (result Map) {
 		"dateFrom": "",
 		"apis":     0,
 	}
-	row := manager.db.QueryRow("SELECT requests, hits, errors, created_at FROM stat_global LIMIT 1")
-	var requests int
-	var hits int
-	var errors int
-	var createdAt int
-	err := row.Scan(&requests, &hits, &errors, &createdAt)
+
+	global, err := manager.store.findGlobalStat()
 	if err != nil {
-		//log.Println(err)
-		requests = 0
-		hits = 0
-		errors = 0
-	} else {
-		dateFrom := time.Unix(int64(createdAt), 0)
+		log.Println("Error:" + err.Error())
+	} else if global.CreatedAt > 0 {
+		dateFrom := time.Unix(global.CreatedAt, 0)
 		result["dateFrom"] = fmt.Sprintf("%d-%02d-%02d", dateFrom.Year(), int(dateFrom.Month()), dateFrom.Day())
 	}
 
-	result["requests"] = requests
-	result["hits"] = hits
-	result["errors"] = errors
+	result["requests"] = int(global.Requests)
+	result["hits"] = int(global.Hits)
+	result["errors"] = int(global.Errors)
 	result["apis"] = len(ApiArray)
 
 	return
@@ -780,5 +571,8 @@ func (manager *StatManager) clearWatchLogs() {
 
 // 关闭统计管理器
 func (manager *StatManager) closeDb() {
-	manager.db.Close()
+	err := manager.store.close()
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
 }
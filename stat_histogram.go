@@ -0,0 +1,137 @@
+package MeloyApi
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 耗时分布的桶上限（毫秒），大致按照对数分布，超出最后一个上限的计入溢出桶
+var statLatencyBuckets = []int64{1, 2, 3, 5, 7, 10, 15, 20, 30, 50, 75, 100, 150, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 5000, 7500, 10000, 15000, 30000, 60000}
+
+// 耗时分布，每个元素为对应桶中的请求数，最后一个元素为溢出桶
+type StatHistogram []int64
+
+// 百分位数
+type StatPercentiles struct {
+	P50 int `json:"p50"`
+	P90 int `json:"p90"`
+	P95 int `json:"p95"`
+	P99 int `json:"p99"`
+}
+
+// 创建耗时分布
+func newStatHistogram() StatHistogram {
+	return make(StatHistogram, len(statLatencyBuckets)+1)
+}
+
+// 从字符串中解析耗时分布，格式为用逗号分隔的数字
+func decodeStatHistogram(s string) StatHistogram {
+	histogram := newStatHistogram()
+	if len(s) == 0 {
+		return histogram
+	}
+
+	for index, piece := range strings.Split(s, ",") {
+		if index >= len(histogram) {
+			break
+		}
+		count, err := strconv.ParseInt(piece, 10, 64)
+		if err != nil {
+			continue
+		}
+		histogram[index] = count
+	}
+	return histogram
+}
+
+// 记录一次耗时
+func (histogram StatHistogram) add(ms int64) {
+	for index, bound := range statLatencyBuckets {
+		if ms <= bound {
+			histogram[index]++
+			return
+		}
+	}
+	histogram[len(statLatencyBuckets)]++
+}
+
+// 合并另外一个耗时分布
+func (histogram StatHistogram) merge(other StatHistogram) {
+	for index, count := range other {
+		if index >= len(histogram) {
+			break
+		}
+		histogram[index] += count
+	}
+}
+
+// 总请求数
+func (histogram StatHistogram) count() (total int64) {
+	for _, count := range histogram {
+		total += count
+	}
+	return
+}
+
+// 计算百分位数，percent取值0-100，在桶内按照线性插值估算
+func (histogram StatHistogram) percentile(percent float64) int {
+	total := histogram.count()
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(float64(total) * percent / 100))
+	if rank < 1 {
+		rank = 1
+	}
+
+	cumulative := int64(0)
+	for index, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		if cumulative+count < rank {
+			cumulative += count
+			continue
+		}
+
+		// 溢出桶无法估算，直接返回最后一个上限
+		if index >= len(statLatencyBuckets) {
+			return int(statLatencyBuckets[len(statLatencyBuckets)-1])
+		}
+
+		lower := int64(0)
+		if index > 0 {
+			lower = statLatencyBuckets[index-1]
+		}
+		upper := statLatencyBuckets[index]
+		return int(lower + (upper-lower)*(rank-cumulative)/count)
+	}
+
+	return int(statLatencyBuckets[len(statLatencyBuckets)-1])
+}
+
+// 常用的百分位数
+func (histogram StatHistogram) percentiles() StatPercentiles {
+	return StatPercentiles{
+		P50: histogram.percentile(50),
+		P90: histogram.percentile(90),
+		P95: histogram.percentile(95),
+		P99: histogram.percentile(99),
+	}
+}
+
+// 转换为字符串以便保存，省略末尾的0
+func (histogram StatHistogram) encode() string {
+	last := len(histogram) - 1
+	for last >= 0 && histogram[last] == 0 {
+		last--
+	}
+
+	pieces := []string{}
+	for index := 0; index <= last; index++ {
+		pieces = append(pieces, strconv.FormatInt(histogram[index], 10))
+	}
+	return strings.Join(pieces, ",")
+}
@@ -0,0 +1,326 @@
+package MeloyApi
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 分组方式
+const (
+	STAT_GROUP_API      = "api"
+	STAT_GROUP_SERVER   = "server"
+	STAT_GROUP_HOST     = "host"
+	STAT_GROUP_CONSUMER = "consumer"
+)
+
+// 时间范围内最多的数据点数，超出时自动加大间隔
+const STAT_RANGE_MAX_POINTS = 2000
+
+// 时间范围最多跨越的天数
+const STAT_RANGE_MAX_DAYS = 800
+
+// 时间范围查询
+type StatRange struct {
+	From     time.Time
+	To       time.Time
+	Interval time.Duration
+	Group    string
+}
+
+// 从请求参数中分析时间范围，from和to默认为最近24小时，interval默认根据时间范围自动选择
+func parseStatRange(query url.Values) (statRange StatRange, err error) {
+	statRange.To = time.Now()
+	if len(query.Get("to")) > 0 {
+		statRange.To, err = parseStatTime(query.Get("to"))
+		if err != nil {
+			return
+		}
+	}
+
+	statRange.From = statRange.To.Add(-24 * time.Hour)
+	if len(query.Get("from")) > 0 {
+		statRange.From, err = parseStatTime(query.Get("from"))
+		if err != nil {
+			return
+		}
+	}
+
+	if !statRange.From.Before(statRange.To) {
+		err = errors.New("'from' should be earlier than 'to'")
+		return
+	}
+	if statRange.To.Sub(statRange.From) > STAT_RANGE_MAX_DAYS*24*time.Hour {
+		err = errors.New("time range should not exceed " + strconv.Itoa(STAT_RANGE_MAX_DAYS) + " days")
+		return
+	}
+
+	if len(query.Get("interval")) > 0 {
+		statRange.Interval, err = parsePeriodFromString(query.Get("interval"))
+		if err != nil {
+			return
+		}
+	}
+	if statRange.Interval < time.Minute {
+		statRange.Interval = autoStatInterval(statRange.To.Sub(statRange.From))
+	}
+
+	// 限制数据点的数量
+	for statRange.To.Sub(statRange.From)/statRange.Interval > STAT_RANGE_MAX_POINTS {
+		statRange.Interval *= 2
+	}
+
+	statRange.Group = strings.ToLower(query.Get("group"))
+	switch statRange.Group {
+	case "", STAT_GROUP_API, STAT_GROUP_SERVER, STAT_GROUP_HOST, STAT_GROUP_CONSUMER:
+	default:
+		err = errors.New("invalid group '" + statRange.Group + "'")
+	}
+	return
+}
+
+// 分析时间，支持Unix时间戳、2006-01-02、2006-01-02 15:04、2006-01-02 15:04:05和RFC3339格式
+func parseStatTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time '" + value + "'")
+}
+
+// 根据时间范围选择间隔
+func autoStatInterval(duration time.Duration) time.Duration {
+	switch {
+	case duration <= 2*time.Hour:
+		return time.Minute
+	case duration <= 24*time.Hour:
+		return 5 * time.Minute
+	case duration <= 7*24*time.Hour:
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// 格式化间隔
+func formatStatInterval(interval time.Duration) string {
+	if interval%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(interval/(24*time.Hour))) + "d"
+	}
+	if interval%time.Hour == 0 {
+		return strconv.Itoa(int(interval/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(interval/time.Minute)) + "m"
+}
+
+// 遍历时间范围内的统计数据，每一天按照数据所在的精度（按分钟、按小时或者按天）读取，path为空时读取所有API
+// 汇总后的数据只要和时间范围有重叠就保留，所以数据的时间可能早于开始时间
+func (manager *StatManager) walkRange(statRange StatRange, path string, fn func(row StatRow, granularity time.Duration)) {
+	day := truncateStatTime(statRange.From, STAT_GRANULARITY_DAY)
+	for ; day.Before(statRange.To); day = day.AddDate(0, 0, 1) {
+		rows, granularity := manager.findStatRows(formatStatDate(day), path)
+		duration := statGranularityDuration(granularity)
+		for _, row := range rows {
+			if !row.Time.Add(duration).After(statRange.From) || !row.Time.Before(statRange.To) {
+				continue
+			}
+			fn(row, duration)
+		}
+	}
+}
+
+// 取得时间范围内的时间序列，每个分组一个序列，每个间隔一个数据点
+func (manager *StatManager) findSeries(path string, statRange StatRange) Map {
+	countPoints := int(statRange.To.Sub(statRange.From) / statRange.Interval)
+	if statRange.To.Sub(statRange.From)%statRange.Interval > 0 {
+		countPoints++
+	}
+
+	series := map[string][]*StatData{}
+	granularity := time.Minute
+	manager.walkRange(statRange, path, func(row StatRow, rowGranularity time.Duration) {
+		if rowGranularity > granularity {
+			granularity = rowGranularity
+		}
+
+		name := statGroupName(row.StatData, statRange.Group)
+		points, ok := series[name]
+		if !ok {
+			points = make([]*StatData, countPoints)
+			series[name] = points
+		}
+
+		// 开始时间之前的汇总数据计入第一个数据点
+		index := 0
+		if row.Time.After(statRange.From) {
+			index = int(row.Time.Sub(statRange.From) / statRange.Interval)
+		}
+		if index >= countPoints {
+			return
+		}
+		if points[index] == nil {
+			points[index] = &StatData{
+				Histogram:   newStatHistogram(),
+				StatusCodes: StatStatusCodes{},
+			}
+		}
+		points[index].merge(row.StatData)
+	})
+
+	names := []string{}
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []Map{}
+	for _, name := range names {
+		points := []Map{}
+		for index, data := range series[name] {
+			t := statRange.From.Add(time.Duration(index) * statRange.Interval)
+			if data == nil {
+				data = &StatData{
+					Histogram:   newStatHistogram(),
+					StatusCodes: StatStatusCodes{},
+				}
+			}
+			point := statDataSummary(*data)
+			point["time"] = t.Unix()
+			points = append(points, point)
+		}
+		result = append(result, Map{
+			"name":   name,
+			"points": points,
+		})
+	}
+
+	return Map{
+		"from":        statRange.From.Unix(),
+		"to":          statRange.To.Unix(),
+		"interval":    formatStatInterval(statRange.Interval),
+		"granularity": formatStatInterval(granularity),
+		"group":       statRange.Group,
+		"series":      result,
+	}
+}
+
+// 时间范围内的排名，kind为requests、hits、errors或者cost
+func (manager *StatManager) findRangeRank(kind string, statRange StatRange, size int, classes []string) []Map {
+	group := statRange.Group
+	if len(group) == 0 {
+		group = STAT_GROUP_API
+	}
+
+	groups := map[string]*StatData{}
+	manager.walkRange(statRange, "", func(row StatRow, _ time.Duration) {
+		name := statGroupName(row.StatData, group)
+		data, ok := groups[name]
+		if !ok {
+			data = &StatData{
+				Histogram:   newStatHistogram(),
+				StatusCodes: StatStatusCodes{},
+			}
+			groups[name] = data
+		}
+		data.merge(row.StatData)
+	})
+
+	items := []Map{}
+	values := map[string]float64{}
+	for name, data := range groups {
+		if data.Requests == 0 {
+			continue
+		}
+
+		var value float64
+		switch kind {
+		case "hits":
+			value = float64(data.Hits) * 100 / float64(data.Requests)
+		case "errors":
+			value = float64(countStatErrors(*data, classes)) * 100 / float64(data.Requests)
+		case "cost":
+			value = float64(data.TotalMs) / float64(data.Requests)
+		default:
+			value = float64(data.Requests)
+		}
+		if (kind == "hits" || kind == "errors") && value <= 0 {
+			continue
+		}
+
+		item := statDataSummary(*data)
+		item["name"] = name
+		if group == STAT_GROUP_API {
+			item["path"] = name
+		}
+		switch kind {
+		case "hits", "errors":
+			item["percent"] = value
+		case "cost":
+			item["ms"] = int(value)
+		default:
+			item["count"] = data.Requests
+		}
+		values[name] = value
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		vi := values[items[i]["name"].(string)]
+		vj := values[items[j]["name"].(string)]
+		if vi == vj {
+			return items[i]["name"].(string) < items[j]["name"].(string)
+		}
+		return vi > vj
+	})
+
+	if len(items) > size {
+		items = items[:size]
+	}
+	return items
+}
+
+// 分组名称
+func statGroupName(data StatData, group string) string {
+	switch group {
+	case STAT_GROUP_API:
+		return data.Path
+	case STAT_GROUP_SERVER:
+		return data.Server
+	case STAT_GROUP_HOST:
+		return data.Host
+	case STAT_GROUP_CONSUMER:
+		return data.Consumer
+	}
+	return "all"
+}
+
+// 统计数据摘要
+func statDataSummary(data StatData) Map {
+	avgMs := 0
+	if data.Requests > 0 {
+		avgMs = int(data.TotalMs / data.Requests)
+	}
+	percentiles := data.Histogram.percentiles()
+	return Map{
+		"requests": data.Requests,
+		"errors":   data.Errors,
+		"hits":     data.Hits,
+		"avgMs":    avgMs,
+		"p50":      percentiles.P50,
+		"p90":      percentiles.P90,
+		"p95":      percentiles.P95,
+		"p99":      percentiles.P99,
+		"statuses": data.StatusCodes.statuses(),
+	}
+}
@@ -0,0 +1,236 @@
+package MeloyApi
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// 统计数据配置
+type StatConfig struct {
+	MinuteDays   int    `json:"minuteDays"`   // 按分钟统计的数据保留天数，默认30
+	HourlyDays   int    `json:"hourlyDays"`   // 按小时汇总的数据保留天数，默认90
+	DailyMonths  int    `json:"dailyMonths"`  // 按天汇总的数据保留月数，默认24
+	DebugLogDays int    `json:"debugLogDays"` // 调试日志保留天数，默认7
+	Vacuum       string `json:"vacuum"`       // 整理数据库文件的周期，比如 7d，默认为7d
+	Store        string `json:"store"`        // 存储方式：sqlite、file或者memory，默认为sqlite
+}
+
+const (
+	STAT_DEFAULT_MINUTE_DAYS    = 30
+	STAT_DEFAULT_HOURLY_DAYS    = 90
+	STAT_DEFAULT_DAILY_MONTHS   = 24
+	STAT_DEFAULT_DEBUG_LOG_DAYS = 7
+	STAT_DEFAULT_VACUUM         = 7 * 24 * time.Hour
+)
+
+// 汇总任务的执行间隔
+const STAT_COMPACT_INTERVAL = 1 * time.Hour
+
+var lastStatCompactAt time.Time
+
+// 每小时执行一次汇总和清理
+func (manager *StatManager) compactIfNeeded() {
+	if time.Since(lastStatCompactAt) < STAT_COMPACT_INTERVAL {
+		return
+	}
+	lastStatCompactAt = time.Now()
+
+	manager.compact(time.Now())
+}
+
+// 汇总已经结束的日期的数据，清理过期的数据，并定期整理存储
+func (manager *StatManager) compact(now time.Time) {
+	config := appConfig.Stat
+	minuteDays := config.MinuteDays
+	if minuteDays <= 0 {
+		minuteDays = STAT_DEFAULT_MINUTE_DAYS
+	}
+	hourlyDays := config.HourlyDays
+	if hourlyDays <= 0 {
+		hourlyDays = STAT_DEFAULT_HOURLY_DAYS
+	}
+	dailyMonths := config.DailyMonths
+	if dailyMonths <= 0 {
+		dailyMonths = STAT_DEFAULT_DAILY_MONTHS
+	}
+	debugLogDays := config.DebugLogDays
+	if debugLogDays <= 0 {
+		debugLogDays = STAT_DEFAULT_DEBUG_LOG_DAYS
+	}
+	vacuumPeriod := STAT_DEFAULT_VACUUM
+	if len(config.Vacuum) > 0 {
+		period, err := parsePeriodFromString(config.Vacuum)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		} else if period > 0 {
+			vacuumPeriod = period
+		}
+	}
+
+	today := formatStatDate(now)
+	minuteCutoff := formatStatDate(now.AddDate(0, 0, -minuteDays))
+	debugLogCutoff := formatStatDate(now.AddDate(0, 0, -debugLogDays))
+	hourlyCutoff := formatStatDate(now.AddDate(0, 0, -hourlyDays))
+	dailyCutoff := formatStatDate(now.AddDate(0, -dailyMonths, 0))
+
+	// 汇总按分钟统计的数据
+	dates, err := manager.store.findDates(STAT_GRANULARITY_MINUTE)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+	for _, date := range dates {
+		if date >= today || manager.isRolledUp(date) {
+			continue
+		}
+
+		err := manager.rollup(date)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	}
+
+	// 删除按分钟统计的数据时跳过还没有汇总成功的日期
+	for _, date := range dates {
+		if date < minuteCutoff && !manager.isRolledUp(date) {
+			minuteCutoff = date
+			break
+		}
+	}
+
+	// 删除过期的数据
+	for _, item := range []struct {
+		granularity string
+		cutoff      string
+	}{
+		{STAT_GRANULARITY_MINUTE, minuteCutoff},
+		{STAT_GRANULARITY_HOUR, hourlyCutoff},
+		{STAT_GRANULARITY_DAY, dailyCutoff},
+	} {
+		err := manager.store.deleteRowsBefore(item.granularity, item.cutoff)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	}
+	err = manager.store.deleteDebugLogsBefore(debugLogCutoff)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+
+	// 整理存储，释放删除数据后的空间
+	vacuumedAt, _ := strconv.ParseInt(manager.store.findMeta("vacuumedAt"), 10, 64)
+	if vacuumedAt == 0 {
+		// 第一次运行时只记录时间
+		manager.setMeta("vacuumedAt", strconv.FormatInt(now.Unix(), 10))
+	} else if now.Sub(time.Unix(vacuumedAt, 0)) >= vacuumPeriod {
+		log.Println("vacuum stat store")
+		err = manager.store.vacuum()
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		} else {
+			manager.setMeta("vacuumedAt", strconv.FormatInt(now.Unix(), 10))
+		}
+	}
+}
+
+// 把某一天按分钟统计的数据汇总为按小时和按天的数据
+func (manager *StatManager) rollup(date string) error {
+	rows, err := manager.store.findRows(STAT_GRANULARITY_MINUTE, date, "")
+	if err != nil {
+		return err
+	}
+
+	hourlyRows := map[string]*StatRow{}
+	dailyRows := map[string]*StatRow{}
+	hourlyKeys := []string{}
+	dailyKeys := []string{}
+	for _, row := range rows {
+		key := row.Server + "$$" + row.Host + "$$" + row.Path + "$$" + row.Consumer
+		hourlyKey := key + "$$" + strconv.Itoa(row.Time.Hour())
+		if addStatRollupRow(hourlyRows, hourlyKey, row, STAT_GRANULARITY_HOUR) {
+			hourlyKeys = append(hourlyKeys, hourlyKey)
+		}
+		if addStatRollupRow(dailyRows, key, row, STAT_GRANULARITY_DAY) {
+			dailyKeys = append(dailyKeys, key)
+		}
+	}
+
+	// 重复汇总时替换之前的结果
+	err = manager.store.replaceRows(STAT_GRANULARITY_HOUR, date, sortedStatRollupRows(hourlyRows, hourlyKeys))
+	if err != nil {
+		return err
+	}
+	err = manager.store.replaceRows(STAT_GRANULARITY_DAY, date, sortedStatRollupRows(dailyRows, dailyKeys))
+	if err != nil {
+		return err
+	}
+
+	return manager.store.setMeta("rollup:"+date, strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// 加入一行汇总数据，返回是否为新的一行
+func addStatRollupRow(rows map[string]*StatRow, key string, row StatRow, granularity string) bool {
+	rollupRow, ok := rows[key]
+	if !ok {
+		rollupRow = &StatRow{
+			StatData: StatData{
+				Server:      row.Server,
+				Host:        row.Host,
+				Path:        row.Path,
+				Consumer:    row.Consumer,
+				Histogram:   newStatHistogram(),
+				StatusCodes: StatStatusCodes{},
+			},
+			Time: truncateStatTime(row.Time, granularity),
+		}
+		rows[key] = rollupRow
+	}
+
+	rollupRow.merge(row.StatData)
+	return !ok
+}
+
+// 按照首次出现的顺序排列汇总数据
+func sortedStatRollupRows(rows map[string]*StatRow, keys []string) []StatRow {
+	result := []StatRow{}
+	for _, key := range keys {
+		result = append(result, *rows[key])
+	}
+	return result
+}
+
+// 判断某一天的数据是否已经汇总
+func (manager *StatManager) isRolledUp(date string) bool {
+	return len(manager.store.findMeta("rollup:"+date)) > 0
+}
+
+// 取得某一天某个接口的统计数据，按分钟的数据已经清理时使用按小时或者按天汇总的数据，path为空时取得所有接口的数据
+func (manager *StatManager) findStatRows(date string, path string) (rows []StatRow, granularity string) {
+	for _, granularity := range statGranularities {
+		if !manager.store.hasRows(granularity, date) {
+			continue
+		}
+
+		rows, err := manager.store.findRows(granularity, date, path)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+		return rows, granularity
+	}
+
+	return []StatRow{}, STAT_GRANULARITY_MINUTE
+}
+
+// 写入元数据
+func (manager *StatManager) setMeta(name string, value string) {
+	err := manager.store.setMeta(name, value)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+}
+
+// 格式化日期，用于表名
+func formatStatDate(t time.Time) string {
+	return fmt.Sprintf("%d%02d%02d", t.Year(), int(t.Month()), t.Day())
+}
@@ -0,0 +1,182 @@
+package MeloyApi
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 排名和告警中可以作为错误统计的状态分类
+var statErrorClasses = map[string]bool{
+	"errors":   true,
+	"gateway":  true,
+	"rejected": true,
+	"1xx":      true,
+	"2xx":      true,
+	"3xx":      true,
+	"4xx":      true,
+	"5xx":      true,
+}
+
+// 每个状态码的请求数，状态码为0表示网关自身出错，没有得到API服务器的响应
+// 负数表示网关拒绝了请求，没有转发到API服务器，比如-429为限流拒绝，不计入任何状态码分类
+type StatStatusCodes map[int]int64
+
+// 状态码统计
+type StatStatuses struct {
+	Status1xx     int              `json:"1xx"`
+	Status2xx     int              `json:"2xx"`
+	Status3xx     int              `json:"3xx"`
+	Status4xx     int              `json:"4xx"`
+	Status5xx     int              `json:"5xx"`
+	GatewayErrors int              `json:"gatewayErrors"`
+	Rejected      int              `json:"rejected"`
+	TopCodes      []StatStatusCode `json:"topCodes"`
+}
+
+// 单个状态码的请求数
+type StatStatusCode struct {
+	Code  int   `json:"code"`
+	Count int64 `json:"count"`
+}
+
+// 从字符串中解析状态码统计，格式为"200:10,404:2"
+func decodeStatStatusCodes(s string) StatStatusCodes {
+	codes := StatStatusCodes{}
+	if len(s) == 0 {
+		return codes
+	}
+
+	for _, piece := range strings.Split(s, ",") {
+		index := strings.Index(piece, ":")
+		if index <= 0 {
+			continue
+		}
+		code, err := strconv.Atoi(piece[:index])
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseInt(piece[index+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		codes[code] += count
+	}
+	return codes
+}
+
+// 记录一次请求
+func (codes StatStatusCodes) add(statusCode int) {
+	codes[statusCode]++
+}
+
+// 合并另外一个状态码统计
+func (codes StatStatusCodes) merge(other StatStatusCodes) {
+	for code, count := range other {
+		codes[code] += count
+	}
+}
+
+// 某一类状态码的请求数，比如class为5时统计5xx
+func (codes StatStatusCodes) countClass(class int) (total int64) {
+	for code, count := range codes {
+		if code/100 == class {
+			total += count
+		}
+	}
+	return
+}
+
+// 网关拒绝的请求数
+func (codes StatStatusCodes) countRejected() (total int64) {
+	for code, count := range codes {
+		if code < 0 {
+			total += count
+		}
+	}
+	return
+}
+
+// 按照请求数排序的前几个状态码，不包括网关出错和拒绝的
+func (codes StatStatusCodes) top(size int) []StatStatusCode {
+	result := []StatStatusCode{}
+	for code, count := range codes {
+		if code <= 0 {
+			continue
+		}
+		result = append(result, StatStatusCode{
+			Code:  code,
+			Count: count,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count == result[j].Count {
+			return result[i].Code < result[j].Code
+		}
+		return result[i].Count > result[j].Count
+	})
+
+	if len(result) > size {
+		result = result[:size]
+	}
+	return result
+}
+
+// 转换为输出的统计信息
+func (codes StatStatusCodes) statuses() StatStatuses {
+	return StatStatuses{
+		Status1xx:     int(codes.countClass(1)),
+		Status2xx:     int(codes.countClass(2)),
+		Status3xx:     int(codes.countClass(3)),
+		Status4xx:     int(codes.countClass(4)),
+		Status5xx:     int(codes.countClass(5)),
+		GatewayErrors: int(codes[0]),
+		Rejected:      int(codes.countRejected()),
+		TopCodes:      codes.top(5),
+	}
+}
+
+// 转换为字符串以便保存
+func (codes StatStatusCodes) encode() string {
+	keys := []int{}
+	for code := range codes {
+		keys = append(keys, code)
+	}
+	sort.Ints(keys)
+
+	pieces := []string{}
+	for _, code := range keys {
+		pieces = append(pieces, strconv.Itoa(code)+":"+strconv.FormatInt(codes[code], 10))
+	}
+	return strings.Join(pieces, ",")
+}
+
+// 按照分类计算错误数，分类为空时使用默认的错误数
+func countStatErrors(data StatData, classes []string) (count int64) {
+	found := map[string]bool{}
+	for _, class := range classes {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if !statErrorClasses[class] || found[class] {
+			continue
+		}
+		found[class] = true
+
+		switch class {
+		case "errors":
+			count += data.Errors
+		case "gateway":
+			count += data.StatusCodes[0]
+		case "rejected":
+			count += data.StatusCodes.countRejected()
+		default:
+			classNumber, _ := strconv.Atoi(class[:1])
+			count += data.StatusCodes.countClass(classNumber)
+		}
+	}
+
+	if len(found) == 0 {
+		return data.Errors
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package MeloyApi
+
+import (
+	"errors"
+	"time"
+)
+
+// 统计数据存储方式
+const (
+	STAT_STORE_SQLITE = "sqlite"
+	STAT_STORE_FILE   = "file"
+	STAT_STORE_MEMORY = "memory"
+)
+
+// 统计数据的精度
+const (
+	STAT_GRANULARITY_MINUTE = "minute"
+	STAT_GRANULARITY_HOUR   = "hour"
+	STAT_GRANULARITY_DAY    = "day"
+)
+
+// 按照从细到粗排列的精度
+var statGranularities = []string{STAT_GRANULARITY_MINUTE, STAT_GRANULARITY_HOUR, STAT_GRANULARITY_DAY}
+
+// 一行统计数据，Time为数据所在的分钟、小时或者天的开始时间
+type StatRow struct {
+	StatData
+
+	Time time.Time
+}
+
+// 全部的请求数、命中数、错误数
+type StatGlobal struct {
+	Requests  int64 `json:"requests"`
+	Hits      int64 `json:"hits"`
+	Errors    int64 `json:"errors"`
+	CreatedAt int64 `json:"createdAt"`
+}
+
+// 限流计数，用于在重启后恢复按天和按月的配额等计数
+type StatRateLimit struct {
+	Tokens      float64 `json:"tokens"`
+	WindowStart int64   `json:"windowStart"`
+	Current     int     `json:"current"`
+	Previous    int     `json:"previous"`
+	UpdatedAt   int64   `json:"updatedAt"`
+}
+
+// 统计数据存储，只负责数据的读写，汇总和计算在StatManager中进行
+// date的格式为YYYYMMDD，granularity为STAT_GRANULARITY_*
+type StatStore interface {
+	// 打开存储，dir为数据目录
+	open(dir string) error
+
+	// 关闭存储
+	close() error
+
+	// 追加某一天的统计数据
+	writeRows(granularity string, date string, rows []StatRow) error
+
+	// 替换某一天的所有统计数据
+	replaceRows(granularity string, date string, rows []StatRow) error
+
+	// 读取某一天的统计数据，按照写入的顺序排列，path为空时读取所有API
+	findRows(granularity string, date string, path string) ([]StatRow, error)
+
+	// 判断某一天是否有统计数据
+	hasRows(granularity string, date string) bool
+
+	// 有统计数据的日期，按照日期排序
+	findDates(granularity string) ([]string, error)
+
+	// 删除某个日期之前的统计数据
+	deleteRowsBefore(granularity string, date string) error
+
+	// 追加调试日志
+	writeDebugLogs(date string, logs []DebugLog) error
+
+	// 读取某个API最近的调试日志，按照时间倒序排列
+	findDebugLogs(date string, path string, size int) ([]DebugLog, error)
+
+	// 删除某个日期之前的调试日志
+	deleteDebugLogsBefore(date string) error
+
+	// 累加全局统计
+	addGlobalStat(requests int64, hits int64, errors int64) error
+
+	// 读取全局统计，没有数据时CreatedAt为0
+	findGlobalStat() (StatGlobal, error)
+
+	// 读取元数据
+	findMeta(name string) string
+
+	// 写入元数据
+	setMeta(name string, value string) error
+
+	// 读取某个限流器的所有计数，key => 计数
+	findRateLimits(limiter string) (map[string]StatRateLimit, error)
+
+	// 保存某个限流器的计数
+	saveRateLimits(limiter string, counters map[string]StatRateLimit) error
+
+	// 删除某个限流器的部分计数
+	deleteRateLimits(limiter string, keys []string) error
+
+	// 整理存储，释放删除数据后的空间
+	vacuum() error
+}
+
+// 根据存储方式创建存储，为空时使用SQLite
+func newStatStore(kind string) (StatStore, error) {
+	switch kind {
+	case "", STAT_STORE_SQLITE:
+		return &SQLiteStatStore{}, nil
+	case STAT_STORE_FILE:
+		return &FileStatStore{}, nil
+	case STAT_STORE_MEMORY:
+		return &MemoryStatStore{}, nil
+	}
+	return nil, errors.New("invalid stat store '" + kind + "'")
+}
+
+// 检查精度是否有效
+func validateStatGranularity(granularity string) error {
+	for _, value := range statGranularities {
+		if value == granularity {
+			return nil
+		}
+	}
+	return errors.New("invalid granularity '" + granularity + "'")
+}
+
+// 精度对应的时长
+func statGranularityDuration(granularity string) time.Duration {
+	switch granularity {
+	case STAT_GRANULARITY_HOUR:
+		return time.Hour
+	case STAT_GRANULARITY_DAY:
+		return 24 * time.Hour
+	}
+	return time.Minute
+}
+
+// 把时间截断到所在精度的开始
+func truncateStatTime(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case STAT_GRANULARITY_HOUR:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+	case STAT_GRANULARITY_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+}
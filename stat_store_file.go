@@ -0,0 +1,514 @@
+package MeloyApi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 使用文件存储统计数据，不依赖cgo
+// 每种精度的数据和调试日志每天一个文件，每行一条JSON记录，只追加写入，汇总时整个文件替换
+type FileStatStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// 文件中的一条统计数据
+type fileStatRecord struct {
+	Time        int64  `json:"time"`
+	Server      string `json:"server"`
+	Host        string `json:"host"`
+	Path        string `json:"path"`
+	Consumer    string `json:"consumer,omitempty"`
+	TotalMs     int64  `json:"totalMs"`
+	Requests    int64  `json:"requests"`
+	Errors      int64  `json:"errors"`
+	Hits        int64  `json:"hits"`
+	Histogram   string `json:"histogram,omitempty"`
+	StatusCodes string `json:"statusCodes,omitempty"`
+}
+
+// 打开存储，数据存放在 dir/stat/ 下
+func (store *FileStatStore) open(dir string) error {
+	store.dir = dir + "/stat"
+	for _, subDir := range append(append([]string{}, statGranularities...), "debug") {
+		err := os.MkdirAll(store.dir+"/"+subDir, 0777)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 关闭存储
+func (store *FileStatStore) close() error {
+	return nil
+}
+
+// 某一天的数据文件
+func (store *FileStatStore) file(kind string, date string) (string, error) {
+	if _, err := strconv.Atoi(date); err != nil || len(date) != 8 {
+		return "", errors.New("invalid date '" + date + "'")
+	}
+	if kind != "debug" {
+		if err := validateStatGranularity(kind); err != nil {
+			return "", err
+		}
+	}
+	return store.dir + "/" + kind + "/" + date + ".log", nil
+}
+
+// 追加统计数据
+func (store *FileStatStore) writeRows(granularity string, date string, rows []StatRow) error {
+	file, err := store.file(granularity, date)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.appendLines(file, encodeFileStatRecords(rows))
+}
+
+// 替换统计数据
+func (store *FileStatStore) replaceRows(granularity string, date string, rows []StatRow) error {
+	file, err := store.file(granularity, date)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.replaceFile(file, encodeFileStatRecords(rows))
+}
+
+// 读取统计数据
+func (store *FileStatStore) findRows(granularity string, date string, path string) (rows []StatRow, err error) {
+	rows = []StatRow{}
+
+	file, err := store.file(granularity, date)
+	if err != nil {
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = store.readLines(file, func(line []byte) {
+		record := fileStatRecord{}
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			return
+		}
+		if len(path) > 0 && record.Path != path {
+			return
+		}
+
+		rows = append(rows, StatRow{
+			StatData: StatData{
+				Server:      record.Server,
+				Host:        record.Host,
+				Path:        record.Path,
+				Consumer:    record.Consumer,
+				TotalMs:     record.TotalMs,
+				Requests:    record.Requests,
+				Errors:      record.Errors,
+				Hits:        record.Hits,
+				Histogram:   decodeStatHistogram(record.Histogram),
+				StatusCodes: decodeStatStatusCodes(record.StatusCodes),
+			},
+			Time: time.Unix(record.Time, 0),
+		})
+	})
+	return
+}
+
+// 判断是否有统计数据
+func (store *FileStatStore) hasRows(granularity string, date string) bool {
+	file, err := store.file(granularity, date)
+	if err != nil {
+		return false
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stat, err := os.Stat(file)
+	return err == nil && stat.Size() > 0
+}
+
+// 有统计数据的日期
+func (store *FileStatStore) findDates(granularity string) ([]string, error) {
+	if err := validateStatGranularity(granularity); err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.findFileDates(granularity)
+}
+
+// 删除某个日期之前的统计数据
+func (store *FileStatStore) deleteRowsBefore(granularity string, date string) error {
+	if err := validateStatGranularity(granularity); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.deleteFilesBefore(granularity, date)
+}
+
+// 追加调试日志
+func (store *FileStatStore) writeDebugLogs(date string, logs []DebugLog) error {
+	file, err := store.file("debug", date)
+	if err != nil {
+		return err
+	}
+
+	lines := [][]byte{}
+	for _, debugLog := range logs {
+		line, err := json.Marshal(debugLog)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.appendLines(file, lines)
+}
+
+// 读取调试日志
+func (store *FileStatStore) findDebugLogs(date string, path string, size int) (logs []DebugLog, err error) {
+	logs = []DebugLog{}
+
+	file, err := store.file("debug", date)
+	if err != nil {
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = store.readLines(file, func(line []byte) {
+		debugLog := DebugLog{}
+		err := json.Unmarshal(line, &debugLog)
+		if err != nil || debugLog.Path != path {
+			return
+		}
+		logs = append(logs, debugLog)
+	})
+
+	// 按照时间倒序
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	if len(logs) > size {
+		logs = logs[:size]
+	}
+	return
+}
+
+// 删除某个日期之前的调试日志
+func (store *FileStatStore) deleteDebugLogsBefore(date string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.deleteFilesBefore("debug", date)
+}
+
+// 累加全局统计
+func (store *FileStatStore) addGlobalStat(requests int64, hits int64, errors int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	global := StatGlobal{}
+	err := store.readJSON("global.json", &global)
+	if err != nil {
+		return err
+	}
+	if global.CreatedAt == 0 {
+		global.CreatedAt = time.Now().Unix()
+	}
+	global.Requests += requests
+	global.Hits += hits
+	global.Errors += errors
+
+	return store.writeJSON("global.json", global)
+}
+
+// 读取全局统计
+func (store *FileStatStore) findGlobalStat() (global StatGlobal, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = store.readJSON("global.json", &global)
+	return
+}
+
+// 读取元数据
+func (store *FileStatStore) findMeta(name string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	meta := map[string]string{}
+	err := store.readJSON("meta.json", &meta)
+	if err != nil {
+		log.Println("Error:" + err.Error())
+	}
+	return meta[name]
+}
+
+// 写入元数据
+func (store *FileStatStore) setMeta(name string, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	meta := map[string]string{}
+	err := store.readJSON("meta.json", &meta)
+	if err != nil {
+		return err
+	}
+	meta[name] = value
+	return store.writeJSON("meta.json", meta)
+}
+
+// 读取限流计数
+func (store *FileStatStore) findRateLimits(limiter string) (map[string]StatRateLimit, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	limiters := map[string]map[string]StatRateLimit{}
+	err := store.readJSON("rate_limits.json", &limiters)
+	counters, ok := limiters[limiter]
+	if !ok {
+		counters = map[string]StatRateLimit{}
+	}
+	return counters, err
+}
+
+// 保存限流计数
+func (store *FileStatStore) saveRateLimits(limiter string, counters map[string]StatRateLimit) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	limiters := map[string]map[string]StatRateLimit{}
+	err := store.readJSON("rate_limits.json", &limiters)
+	if err != nil {
+		return err
+	}
+
+	limiterCounters, ok := limiters[limiter]
+	if !ok {
+		limiterCounters = map[string]StatRateLimit{}
+		limiters[limiter] = limiterCounters
+	}
+	for key, counter := range counters {
+		limiterCounters[key] = counter
+	}
+	return store.writeJSON("rate_limits.json", limiters)
+}
+
+// 删除限流计数
+func (store *FileStatStore) deleteRateLimits(limiter string, keys []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	limiters := map[string]map[string]StatRateLimit{}
+	err := store.readJSON("rate_limits.json", &limiters)
+	if err != nil {
+		return err
+	}
+
+	limiterCounters, ok := limiters[limiter]
+	if !ok {
+		return nil
+	}
+	for _, key := range keys {
+		delete(limiterCounters, key)
+	}
+	if len(limiterCounters) == 0 {
+		delete(limiters, limiter)
+	}
+	return store.writeJSON("rate_limits.json", limiters)
+}
+
+// 删除的数据文件已经直接释放空间，不需要整理
+func (store *FileStatStore) vacuum() error {
+	return nil
+}
+
+// 追加多行到文件
+func (store *FileStatStore) appendLines(file string, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	fp, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	// 一次写入，减少中途出错时留下的不完整记录
+	_, err = fp.Write(append(bytes.Join(lines, []byte{'\n'}), '\n'))
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// 使用新的内容替换文件，先写入临时文件再改名，避免出错时丢失数据
+func (store *FileStatStore) replaceFile(file string, lines [][]byte) error {
+	if len(lines) == 0 {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpFile := file + ".tmp"
+	err := ioutil.WriteFile(tmpFile, append(bytes.Join(lines, []byte{'\n'}), '\n'), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// 逐行读取文件，文件不存在时不做任何处理
+func (store *FileStatStore) readLines(file string, fn func(line []byte)) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		fn(line)
+	}
+	return scanner.Err()
+}
+
+// 读取JSON文件，文件不存在时不做任何处理
+func (store *FileStatStore) readJSON(name string, value interface{}) error {
+	data, err := ioutil.ReadFile(store.dir + "/" + name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// 写入JSON文件
+func (store *FileStatStore) writeJSON(name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.replaceFile(store.dir+"/"+name, [][]byte{data})
+}
+
+// 某个目录下数据文件的日期，按照日期排序
+func (store *FileStatStore) findFileDates(kind string) (dates []string, err error) {
+	dates = []string{}
+
+	files, err := ioutil.ReadDir(store.dir + "/" + kind)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".log") {
+			continue
+		}
+		date := strings.TrimSuffix(file.Name(), ".log")
+		if len(date) != 8 {
+			continue
+		}
+		if _, err := strconv.Atoi(date); err != nil {
+			continue
+		}
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	return
+}
+
+// 删除某个目录下某个日期之前的数据文件
+func (store *FileStatStore) deleteFilesBefore(kind string, date string) error {
+	dates, err := store.findFileDates(kind)
+	if err != nil {
+		return err
+	}
+
+	for _, fileDate := range dates {
+		if fileDate >= date {
+			continue
+		}
+		err := os.Remove(store.dir + "/" + kind + "/" + fileDate + ".log")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把统计数据编码为文件中的记录
+func encodeFileStatRecords(rows []StatRow) [][]byte {
+	lines := [][]byte{}
+	for _, row := range rows {
+		line, err := json.Marshal(fileStatRecord{
+			Time:        row.Time.Unix(),
+			Server:      row.Server,
+			Host:        row.Host,
+			Path:        row.Path,
+			Consumer:    row.Consumer,
+			TotalMs:     row.TotalMs,
+			Requests:    row.Requests,
+			Errors:      row.Errors,
+			Hits:        row.Hits,
+			Histogram:   row.Histogram.encode(),
+			StatusCodes: row.StatusCodes.encode(),
+		})
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
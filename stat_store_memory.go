@@ -0,0 +1,269 @@
+package MeloyApi
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 在内存中存储统计数据，重启后数据丢失，主要用于测试
+type MemoryStatStore struct {
+	rows      map[string]map[string][]StatRow // granularity => date => rows
+	debugLogs map[string][]DebugLog           // date => logs
+	global    StatGlobal
+	meta      map[string]string
+	limits    map[string]map[string]StatRateLimit // limiter => key => counter
+
+	mutex sync.Mutex
+}
+
+// 初始化存储
+func (store *MemoryStatStore) open(dir string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.rows = map[string]map[string][]StatRow{}
+	for _, granularity := range statGranularities {
+		store.rows[granularity] = map[string][]StatRow{}
+	}
+	store.debugLogs = map[string][]DebugLog{}
+	store.global = StatGlobal{}
+	store.meta = map[string]string{}
+	store.limits = map[string]map[string]StatRateLimit{}
+	return nil
+}
+
+// 关闭存储
+func (store *MemoryStatStore) close() error {
+	return nil
+}
+
+// 追加统计数据
+func (store *MemoryStatStore) writeRows(granularity string, date string, rows []StatRow) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	dates, ok := store.rows[granularity]
+	if !ok {
+		return errors.New("invalid granularity '" + granularity + "'")
+	}
+	dates[date] = append(dates[date], copyStatRows(rows)...)
+	return nil
+}
+
+// 替换统计数据
+func (store *MemoryStatStore) replaceRows(granularity string, date string, rows []StatRow) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	dates, ok := store.rows[granularity]
+	if !ok {
+		return errors.New("invalid granularity '" + granularity + "'")
+	}
+	if len(rows) == 0 {
+		delete(dates, date)
+	} else {
+		dates[date] = copyStatRows(rows)
+	}
+	return nil
+}
+
+// 读取统计数据
+func (store *MemoryStatStore) findRows(granularity string, date string, path string) ([]StatRow, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	dates, ok := store.rows[granularity]
+	if !ok {
+		return []StatRow{}, errors.New("invalid granularity '" + granularity + "'")
+	}
+
+	result := []StatRow{}
+	for _, row := range dates[date] {
+		if len(path) > 0 && row.Path != path {
+			continue
+		}
+		result = append(result, row)
+	}
+	return copyStatRows(result), nil
+}
+
+// 判断是否有统计数据
+func (store *MemoryStatStore) hasRows(granularity string, date string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.rows[granularity][date]) > 0
+}
+
+// 有统计数据的日期
+func (store *MemoryStatStore) findDates(granularity string) ([]string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	dates, ok := store.rows[granularity]
+	if !ok {
+		return nil, errors.New("invalid granularity '" + granularity + "'")
+	}
+
+	result := []string{}
+	for date := range dates {
+		result = append(result, date)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// 删除某个日期之前的统计数据
+func (store *MemoryStatStore) deleteRowsBefore(granularity string, date string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	dates, ok := store.rows[granularity]
+	if !ok {
+		return errors.New("invalid granularity '" + granularity + "'")
+	}
+	for rowDate := range dates {
+		if rowDate < date {
+			delete(dates, rowDate)
+		}
+	}
+	return nil
+}
+
+// 追加调试日志
+func (store *MemoryStatStore) writeDebugLogs(date string, logs []DebugLog) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.debugLogs[date] = append(store.debugLogs[date], logs...)
+	return nil
+}
+
+// 读取调试日志
+func (store *MemoryStatStore) findDebugLogs(date string, path string, size int) ([]DebugLog, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	result := []DebugLog{}
+	logs := store.debugLogs[date]
+	for i := len(logs) - 1; i >= 0 && len(result) < size; i-- {
+		if logs[i].Path == path {
+			result = append(result, logs[i])
+		}
+	}
+	return result, nil
+}
+
+// 删除某个日期之前的调试日志
+func (store *MemoryStatStore) deleteDebugLogsBefore(date string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for logDate := range store.debugLogs {
+		if logDate < date {
+			delete(store.debugLogs, logDate)
+		}
+	}
+	return nil
+}
+
+// 累加全局统计
+func (store *MemoryStatStore) addGlobalStat(requests int64, hits int64, errors int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.global.CreatedAt == 0 {
+		store.global.CreatedAt = time.Now().Unix()
+	}
+	store.global.Requests += requests
+	store.global.Hits += hits
+	store.global.Errors += errors
+	return nil
+}
+
+// 读取全局统计
+func (store *MemoryStatStore) findGlobalStat() (StatGlobal, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.global, nil
+}
+
+// 读取元数据
+func (store *MemoryStatStore) findMeta(name string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.meta[name]
+}
+
+// 写入元数据
+func (store *MemoryStatStore) setMeta(name string, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.meta[name] = value
+	return nil
+}
+
+// 读取限流计数
+func (store *MemoryStatStore) findRateLimits(limiter string) (map[string]StatRateLimit, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	counters := map[string]StatRateLimit{}
+	for key, counter := range store.limits[limiter] {
+		counters[key] = counter
+	}
+	return counters, nil
+}
+
+// 保存限流计数
+func (store *MemoryStatStore) saveRateLimits(limiter string, counters map[string]StatRateLimit) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	limiterCounters, ok := store.limits[limiter]
+	if !ok {
+		limiterCounters = map[string]StatRateLimit{}
+		store.limits[limiter] = limiterCounters
+	}
+	for key, counter := range counters {
+		limiterCounters[key] = counter
+	}
+	return nil
+}
+
+// 删除限流计数
+func (store *MemoryStatStore) deleteRateLimits(limiter string, keys []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(store.limits[limiter], key)
+	}
+	return nil
+}
+
+// 内存中的数据不需要整理
+func (store *MemoryStatStore) vacuum() error {
+	return nil
+}
+
+// 复制统计数据，避免调用者修改存储中的耗时分布和状态码统计
+func copyStatRows(rows []StatRow) []StatRow {
+	result := make([]StatRow, 0, len(rows))
+	for _, row := range rows {
+		histogram := newStatHistogram()
+		histogram.merge(row.Histogram)
+		statusCodes := StatStatusCodes{}
+		statusCodes.merge(row.StatusCodes)
+
+		row.Histogram = histogram
+		row.StatusCodes = statusCodes
+		result = append(result, row)
+	}
+	return result
+}
@@ -0,0 +1,723 @@
+package MeloyApi
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 使用SQLite存储统计数据，按分钟的数据和调试日志每天一个表，汇总数据存储在stat_hourly和stat_daily中
+type SQLiteStatStore struct {
+	db *sql.DB
+
+	tables map[string]bool // 已经准备好（创建或者升级过）的表
+	mutex  sync.Mutex
+}
+
+// 汇总表
+const (
+	STAT_TABLE_HOURLY = "stat_hourly"
+	STAT_TABLE_DAILY  = "stat_daily"
+)
+
+// 打开数据库
+func (store *SQLiteStatStore) open(dir string) error {
+	db, err := sql.Open("sqlite3", dir+"/stat.db")
+	if err != nil {
+		return err
+	}
+	store.db = db
+	store.tables = map[string]bool{}
+
+	sqlStmt := ""
+	for _, table := range []string{STAT_TABLE_HOURLY, STAT_TABLE_DAILY} {
+		sqlStmt += strings.Replace(`
+	CREATE TABLE IF NOT EXISTS %{table} (
+		id integer not null primary key autoincrement,
+		date integer,
+		server text,
+		host text,
+		path text,
+		consumer text,
+		ms integer,
+		year integer,
+		month integer,
+		day integer,
+		hour integer,
+		minute integer,
+		requests integer,
+		errors integer,
+		hits integer,
+		histogram text,
+		status_1xx integer,
+		status_2xx integer,
+		status_3xx integer,
+		status_4xx integer,
+		status_5xx integer,
+		gateway_errors integer,
+		status_codes text
+	);
+	CREATE INDEX IF NOT EXISTS %{table}_date_index ON %{table} (date, path);
+	`, "%{table}", table, -1)
+	}
+
+	sqlStmt += `
+	CREATE TABLE IF NOT EXISTS stat_global (
+		id integer not null primary key autoincrement,
+		requests integer,
+		hits integer,
+		errors integer,
+		created_at integer
+	);
+
+	CREATE TABLE IF NOT EXISTS stat_meta (
+		name text not null primary key,
+		value text
+	);
+
+	CREATE TABLE IF NOT EXISTS rate_limits (
+		limiter text not null,
+		key text not null,
+		tokens real,
+		window_start integer,
+		current integer,
+		previous integer,
+		updated_at integer,
+		PRIMARY KEY (limiter, key)
+	);
+	`
+
+	_, err = store.db.Exec(sqlStmt)
+	return err
+}
+
+// 关闭数据库
+func (store *SQLiteStatStore) close() error {
+	return store.db.Close()
+}
+
+// 准备每天按分钟统计的数据表
+func (store *SQLiteStatStore) prepareMinuteTable(date string) error {
+	table := "stat_" + date
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tables[table] {
+		return nil
+	}
+
+	sqlStmt := `
+	CREATE TABLE IF NOT EXISTS stat_%{date} (
+		id integer not null primary key autoincrement,
+		server text,
+		host text,
+		path text,
+		consumer text,
+		ms integer,
+		year integer,
+		month integer,
+		day integer,
+		hour integer,
+		minute integer,
+		requests integer,
+		errors integer,
+		hits integer,
+		histogram text,
+		status_1xx integer,
+		status_2xx integer,
+		status_3xx integer,
+		status_4xx integer,
+		status_5xx integer,
+		gateway_errors integer,
+		status_codes text
+	);
+	CREATE INDEX IF NOT EXISTS server ON stat_%{date} (server);
+	CREATE INDEX IF NOT EXISTS host ON stat_%{date} (host);
+	CREATE INDEX IF NOT EXISTS path_index ON stat_%{date} (path);
+	CREATE INDEX IF NOT EXISTS date_minute_index ON stat_%{date} (path, year, month, day, hour, minute);
+	CREATE INDEX IF NOT EXISTS date_day_index ON stat_%{date} (path, year, month, day);
+	`
+
+	sqlStmt = strings.Replace(sqlStmt, "%{date}", date, -1)
+
+	log.Println("create table for date '" + date + "'")
+
+	_, err := store.db.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// 升级之前创建的表
+	err = store.upgradeMinuteTable(table)
+	if err != nil {
+		return err
+	}
+
+	store.tables[table] = true
+	return nil
+}
+
+// 打开已有的按分钟统计的数据表，每个表只在第一次打开时升级
+func (store *SQLiteStatStore) openMinuteTable(table string) (exists bool, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tables[table] {
+		return true, nil
+	}
+	if !store.tableExists(table) {
+		return false, nil
+	}
+
+	// 之前创建的表中可能缺少字段
+	err = store.upgradeMinuteTable(table)
+	if err != nil {
+		return true, err
+	}
+
+	store.tables[table] = true
+	return true, nil
+}
+
+// 在之前创建的表中加入新的字段
+func (store *SQLiteStatStore) upgradeMinuteTable(table string) error {
+	for _, column := range []string{"consumer", "histogram", "status_1xx", "status_2xx", "status_3xx", "status_4xx", "status_5xx", "gateway_errors", "status_codes"} {
+		columnType := "integer"
+		if column == "consumer" || column == "histogram" || column == "status_codes" {
+			columnType = "text"
+		}
+		err := store.addColumn(table, column, columnType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 如果表中没有某个字段则加入
+func (store *SQLiteStatStore) addColumn(table string, column string, columnType string) error {
+	rows, err := store.db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid int
+		var name string
+		var dataType string
+		var notNull int
+		var defaultValue interface{}
+		var pk int
+		err = rows.Scan(&cid, &name, &dataType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+
+	if exists {
+		return nil
+	}
+
+	_, err = store.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + columnType)
+	return err
+}
+
+// 准备每天的调试日志表
+func (store *SQLiteStatStore) prepareDebugLogTable(date string) error {
+	table := "debug_logs_" + date
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tables[table] {
+		return nil
+	}
+
+	_, err := store.db.Exec(strings.Replace(`
+	CREATE TABLE IF NOT EXISTS debug_logs_%{date} (
+		id integer not null primary key autoincrement,
+		server text,
+		host text,
+		path text,
+		uri text,
+		body string,
+		created_at integer
+	);
+	CREATE INDEX IF NOT EXISTS path_index ON debug_logs_%{date} (path);
+	`, "%{date}", date, -1))
+	if err != nil {
+		return err
+	}
+
+	store.tables[table] = true
+	return nil
+}
+
+// 精度对应的表和查询条件
+func (store *SQLiteStatStore) source(granularity string, date string) (table string, condition string, args []interface{}, err error) {
+	if _, err = strconv.Atoi(date); err != nil || len(date) != 8 {
+		return "", "", nil, errors.New("invalid date '" + date + "'")
+	}
+
+	switch granularity {
+	case STAT_GRANULARITY_MINUTE:
+		return "stat_" + date, "", []interface{}{}, nil
+	case STAT_GRANULARITY_HOUR:
+		dateInt, _ := strconv.Atoi(date)
+		return STAT_TABLE_HOURLY, " AND date=?", []interface{}{dateInt}, nil
+	case STAT_GRANULARITY_DAY:
+		dateInt, _ := strconv.Atoi(date)
+		return STAT_TABLE_DAILY, " AND date=?", []interface{}{dateInt}, nil
+	}
+	return "", "", nil, errors.New("invalid granularity '" + granularity + "'")
+}
+
+// 追加统计数据
+func (store *SQLiteStatStore) writeRows(granularity string, date string, rows []StatRow) error {
+	return store.saveRows(granularity, date, rows, false)
+}
+
+// 替换统计数据
+func (store *SQLiteStatStore) replaceRows(granularity string, date string, rows []StatRow) error {
+	return store.saveRows(granularity, date, rows, true)
+}
+
+// 在一个事务中写入统计数据，replace为true时先删除已有的数据
+func (store *SQLiteStatStore) saveRows(granularity string, date string, rows []StatRow, replace bool) error {
+	table, condition, args, err := store.source(granularity, date)
+	if err != nil {
+		return err
+	}
+
+	if granularity == STAT_GRANULARITY_MINUTE {
+		err = store.prepareMinuteTable(date)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE 1=1"+condition, args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// 汇总表中需要额外写入日期
+	columns := "server,host,path,consumer,ms, year,month,day,hour, minute,requests,errors,hits,histogram, status_1xx,status_2xx,status_3xx,status_4xx,status_5xx,gateway_errors,status_codes"
+	placeholders := "?,?,?,?,?, ?,?,?,?, ?,?,?,?,?, ?,?,?,?,?,?,?"
+	if len(args) > 0 {
+		columns = "date," + columns
+		placeholders = "?," + placeholders
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO " + table + " (" + columns + ") VALUES (" + placeholders + ")")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		var ms int64 = 0
+		if row.Requests > 0 {
+			ms = row.TotalMs / row.Requests
+		}
+		values := append(append([]interface{}{}, args...), row.Server, row.Host, row.Path, row.Consumer, ms, row.Time.Year(), int(row.Time.Month()), row.Time.Day(), row.Time.Hour(), row.Time.Minute(), row.Requests, row.Errors, row.Hits, row.Histogram.encode(),
+			row.StatusCodes.countClass(1), row.StatusCodes.countClass(2), row.StatusCodes.countClass(3), row.StatusCodes.countClass(4), row.StatusCodes.countClass(5), row.StatusCodes[0], row.StatusCodes.encode())
+		_, err := stmt.Exec(values...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// 读取统计数据
+func (store *SQLiteStatStore) findRows(granularity string, date string, path string) (result []StatRow, err error) {
+	result = []StatRow{}
+
+	table, condition, args, err := store.source(granularity, date)
+	if err != nil {
+		return
+	}
+
+	if granularity == STAT_GRANULARITY_MINUTE {
+		exists, err := store.openMinuteTable(table)
+		if err != nil || !exists {
+			return result, err
+		}
+	}
+
+	if len(path) > 0 {
+		condition += " AND path=?"
+		args = append(args, path)
+	}
+
+	rows, err := store.db.Query("SELECT server,host,path,consumer,ms,requests,errors,hits,year,month,day,hour,minute,histogram,status_codes FROM "+table+" WHERE 1=1"+condition+" ORDER BY id ASC", args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var server, host, rowPath, consumer sql.NullString
+		var ms, requests, errors, hits sql.NullInt64
+		var year, month, day, hour, minute int
+		var histogram, statusCodes sql.NullString
+		err := rows.Scan(&server, &host, &rowPath, &consumer, &ms, &requests, &errors, &hits, &year, &month, &day, &hour, &minute, &histogram, &statusCodes)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+
+		result = append(result, StatRow{
+			StatData: StatData{
+				Server:      server.String,
+				Host:        host.String,
+				Path:        rowPath.String,
+				Consumer:    consumer.String,
+				TotalMs:     ms.Int64 * requests.Int64,
+				Requests:    requests.Int64,
+				Errors:      errors.Int64,
+				Hits:        hits.Int64,
+				Histogram:   decodeStatHistogram(histogram.String),
+				StatusCodes: decodeStatStatusCodes(statusCodes.String),
+			},
+			Time: time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.Local),
+		})
+	}
+
+	return
+}
+
+// 判断是否有统计数据
+func (store *SQLiteStatStore) hasRows(granularity string, date string) bool {
+	table, condition, args, err := store.source(granularity, date)
+	if err != nil {
+		return false
+	}
+
+	if granularity == STAT_GRANULARITY_MINUTE {
+		store.mutex.Lock()
+		isPrepared := store.tables[table]
+		store.mutex.Unlock()
+		return isPrepared || store.tableExists(table)
+	}
+
+	var id int
+	err = store.db.QueryRow("SELECT id FROM "+table+" WHERE 1=1"+condition+" LIMIT 1", args...).Scan(&id)
+	return err == nil
+}
+
+// 有统计数据的日期
+func (store *SQLiteStatStore) findDates(granularity string) (dates []string, err error) {
+	switch granularity {
+	case STAT_GRANULARITY_MINUTE:
+		return store.findTableDates("stat_")
+	case STAT_GRANULARITY_HOUR, STAT_GRANULARITY_DAY:
+		table := STAT_TABLE_HOURLY
+		if granularity == STAT_GRANULARITY_DAY {
+			table = STAT_TABLE_DAILY
+		}
+
+		dates = []string{}
+		rows, err := store.db.Query("SELECT DISTINCT date FROM " + table + " ORDER BY date ASC")
+		if err != nil {
+			return dates, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var date int
+			err := rows.Scan(&date)
+			if err != nil {
+				return dates, err
+			}
+			dates = append(dates, strconv.Itoa(date))
+		}
+		return dates, nil
+	}
+	return nil, errors.New("invalid granularity '" + granularity + "'")
+}
+
+// 删除某个日期之前的统计数据
+func (store *SQLiteStatStore) deleteRowsBefore(granularity string, date string) error {
+	switch granularity {
+	case STAT_GRANULARITY_MINUTE:
+		return store.dropTablesBefore("stat_", date)
+	case STAT_GRANULARITY_HOUR, STAT_GRANULARITY_DAY:
+		table := STAT_TABLE_HOURLY
+		if granularity == STAT_GRANULARITY_DAY {
+			table = STAT_TABLE_DAILY
+		}
+		dateInt, _ := strconv.Atoi(date)
+		_, err := store.db.Exec("DELETE FROM "+table+" WHERE date<?", dateInt)
+		return err
+	}
+	return errors.New("invalid granularity '" + granularity + "'")
+}
+
+// 追加调试日志
+func (store *SQLiteStatStore) writeDebugLogs(date string, logs []DebugLog) error {
+	err := store.prepareDebugLogTable(date)
+	if err != nil {
+		return err
+	}
+
+	insertDebugStmt, err := store.db.Prepare("INSERT INTO debug_logs_" + date + " (server, host, path, uri, body, created_at) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	defer insertDebugStmt.Close()
+
+	for _, debugLog := range logs {
+		_, err := insertDebugStmt.Exec(debugLog.Server, debugLog.Host, debugLog.Path, debugLog.URI, debugLog.Log, debugLog.CreatedAt)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+	}
+	return nil
+}
+
+// 读取调试日志
+func (store *SQLiteStatStore) findDebugLogs(date string, path string, size int) (logs []DebugLog, err error) {
+	logs = []DebugLog{}
+
+	if !store.tableExists("debug_logs_" + date) {
+		return
+	}
+
+	stmt, err := store.db.Prepare("SELECT server, host, path, uri, body, created_at FROM debug_logs_" + date + " WHERE path=? ORDER BY id DESC LIMIT " + strconv.Itoa(size))
+	if err != nil {
+		return
+	}
+
+	defer stmt.Close()
+
+	rows, err := stmt.Query(path)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var server string
+		var host string
+		var path string
+		var uri string
+		var body string
+		var createdAt int64
+
+		rows.Scan(&server, &host, &path, &uri, &body, &createdAt)
+
+		logs = append(logs, DebugLog{
+			server,
+			host,
+			path,
+			uri,
+			body,
+			createdAt,
+		})
+	}
+
+	return
+}
+
+// 删除某个日期之前的调试日志
+func (store *SQLiteStatStore) deleteDebugLogsBefore(date string) error {
+	return store.dropTablesBefore("debug_logs_", date)
+}
+
+// 累加全局统计
+func (store *SQLiteStatStore) addGlobalStat(requests int64, hits int64, errors int64) error {
+	var id int
+	err := store.db.QueryRow("SELECT id FROM stat_global LIMIT 1").Scan(&id)
+	if err != nil {
+		_, err = store.db.Exec("INSERT INTO stat_global (requests, hits, errors, created_at) VALUES (?, ?, ?, ?)", 0, 0, 0, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	if requests > 0 || hits > 0 || errors > 0 {
+		_, err = store.db.Exec("UPDATE stat_global SET requests=requests+?,hits=hits+?,errors=errors+?", requests, hits, errors)
+		return err
+	}
+	return nil
+}
+
+// 读取全局统计
+func (store *SQLiteStatStore) findGlobalStat() (global StatGlobal, err error) {
+	err = store.db.QueryRow("SELECT requests, hits, errors, created_at FROM stat_global LIMIT 1").Scan(&global.Requests, &global.Hits, &global.Errors, &global.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// 读取元数据
+func (store *SQLiteStatStore) findMeta(name string) string {
+	var value sql.NullString
+	err := store.db.QueryRow("SELECT value FROM stat_meta WHERE name=?", name).Scan(&value)
+	if err != nil {
+		return ""
+	}
+	return value.String
+}
+
+// 写入元数据
+func (store *SQLiteStatStore) setMeta(name string, value string) error {
+	_, err := store.db.Exec("REPLACE INTO stat_meta (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+// 读取限流计数
+func (store *SQLiteStatStore) findRateLimits(limiter string) (map[string]StatRateLimit, error) {
+	counters := map[string]StatRateLimit{}
+
+	rows, err := store.db.Query("SELECT key, tokens, window_start, current, previous, updated_at FROM rate_limits WHERE limiter=?", limiter)
+	if err != nil {
+		return counters, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		counter := StatRateLimit{}
+		err = rows.Scan(&key, &counter.Tokens, &counter.WindowStart, &counter.Current, &counter.Previous, &counter.UpdatedAt)
+		if err != nil {
+			return counters, err
+		}
+		counters[key] = counter
+	}
+	return counters, rows.Err()
+}
+
+// 保存限流计数
+func (store *SQLiteStatStore) saveRateLimits(limiter string, counters map[string]StatRateLimit) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("REPLACE INTO rate_limits (limiter, key, tokens, window_start, current, previous, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for key, counter := range counters {
+		_, err = stmt.Exec(limiter, key, counter.Tokens, counter.WindowStart, counter.Current, counter.Previous, counter.UpdatedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 删除限流计数
+func (store *SQLiteStatStore) deleteRateLimits(limiter string, keys []string) error {
+	for _, key := range keys {
+		_, err := store.db.Exec("DELETE FROM rate_limits WHERE limiter=? AND key=?", limiter, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 整理数据库文件
+func (store *SQLiteStatStore) vacuum() error {
+	_, err := store.db.Exec("VACUUM")
+	return err
+}
+
+// 判断表是否存在
+func (store *SQLiteStatStore) tableExists(table string) bool {
+	var name string
+	err := store.db.QueryRow("SELECT name FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&name)
+	return err == nil
+}
+
+// 删除某个日期之前按天创建的表
+func (store *SQLiteStatStore) dropTablesBefore(prefix string, date string) error {
+	dates, err := store.findTableDates(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, tableDate := range dates {
+		if tableDate >= date {
+			continue
+		}
+
+		_, err := store.db.Exec("DROP TABLE IF EXISTS " + prefix + tableDate)
+		if err != nil {
+			return err
+		}
+
+		store.mutex.Lock()
+		delete(store.tables, prefix+tableDate)
+		store.mutex.Unlock()
+	}
+	return nil
+}
+
+// 查找按天创建的表的日期，按照日期排序
+func (store *SQLiteStatStore) findTableDates(prefix string) (dates []string, err error) {
+	dates = []string{}
+
+	rows, err := store.db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name LIKE ? ORDER BY name ASC", prefix+"%")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			continue
+		}
+
+		date := strings.TrimPrefix(name, prefix)
+		if len(date) != 8 {
+			continue
+		}
+		if _, err := strconv.Atoi(date); err != nil {
+			continue
+		}
+		dates = append(dates, date)
+	}
+	return
+}
@@ -16,6 +16,16 @@ func containsString(slice []string, item string) bool {
 	return false
 }
 
+// 判断slice中是否包含某个整数
+func containsInt(slice []int, item int) bool {
+	for _, i := range slice {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
 // 从字符串中分析尺寸
 func parseSizeFromString(sizeString string) (float64, error) {
 	if len(sizeString) == 0 {
@@ -0,0 +1,347 @@
+package MeloyApi
+
+import (
+	"container/heap"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 客户端类型
+const (
+	TALKER_KIND_IP         = "ip"
+	TALKER_KIND_CONSUMER   = "consumer"
+	TALKER_KIND_USER_AGENT = "userAgent"
+)
+
+// 时间范围
+const (
+	TALKER_WINDOW_MINUTE = "minute"
+	TALKER_WINDOW_HOUR   = "hour"
+	TALKER_WINDOW_DAY    = "day"
+)
+
+const TALKER_DEFAULT_CAPACITY = 100
+
+// User-Agent最多记录的长度
+const TALKER_MAX_USER_AGENT_LENGTH = 256
+
+// 客户端排行配置
+type TalkerConfig struct {
+	On       bool `json:"on"`       // 是否启用
+	Capacity int  `json:"capacity"` // 每个API每种客户端每分钟（或者每小时）最多跟踪的数量，默认100
+}
+
+// 客户端计数，Error为计数可能多算的最大值
+type TalkerCounter struct {
+	Key   string
+	Count int64
+	Error int64
+
+	index int
+}
+
+// 按照计数排列的最小堆
+type talkerHeap []*TalkerCounter
+
+func (h talkerHeap) Len() int {
+	return len(h)
+}
+
+func (h talkerHeap) Less(i, j int) bool {
+	return h[i].Count < h[j].Count
+}
+
+func (h talkerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *talkerHeap) Push(x interface{}) {
+	counter := x.(*TalkerCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *talkerHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
+
+// 使用Space-Saving算法记录出现次数最多的客户端，最多跟踪capacity个客户端
+// 跟踪数量满了以后新的客户端替换计数最小的客户端，并继承它的计数
+type TalkerSummary struct {
+	capacity int
+	counters map[string]*TalkerCounter
+	heap     talkerHeap
+}
+
+func newTalkerSummary(capacity int) *TalkerSummary {
+	return &TalkerSummary{
+		capacity: capacity,
+		counters: map[string]*TalkerCounter{},
+		heap:     talkerHeap{},
+	}
+}
+
+// 增加计数
+func (summary *TalkerSummary) add(key string) {
+	counter, ok := summary.counters[key]
+	if ok {
+		counter.Count++
+		heap.Fix(&summary.heap, counter.index)
+		return
+	}
+
+	if len(summary.heap) < summary.capacity {
+		counter = &TalkerCounter{
+			Key:   key,
+			Count: 1,
+		}
+		summary.counters[key] = counter
+		heap.Push(&summary.heap, counter)
+		return
+	}
+
+	// 替换计数最小的客户端
+	counter = summary.heap[0]
+	delete(summary.counters, counter.Key)
+	counter.Key = key
+	counter.Error = counter.Count
+	counter.Count++
+	summary.counters[key] = counter
+	heap.Fix(&summary.heap, 0)
+}
+
+// 某个时间段内的客户端计数
+type talkerBucket struct {
+	start     time.Time
+	requests  int64
+	summaries map[string]*TalkerSummary // kind => summary
+}
+
+// 单个API的客户端计数，分别按分钟和按小时记录
+type apiTalkers struct {
+	minutes []*talkerBucket
+	hours   []*talkerBucket
+}
+
+// 客户端排行管理器
+type TalkerManager struct {
+	config TalkerConfig
+	apis   map[string]*apiTalkers // path => talkers
+
+	mutex sync.Mutex
+}
+
+var talkerManager = TalkerManager{
+	apis: map[string]*apiTalkers{},
+}
+
+// 重新加载配置，关闭时清除已有的数据
+func (manager *TalkerManager) reload() {
+	config := appConfig.Talkers
+	if config.Capacity <= 0 {
+		config.Capacity = TALKER_DEFAULT_CAPACITY
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if !config.On || config.Capacity != manager.config.Capacity {
+		manager.apis = map[string]*apiTalkers{}
+	}
+	manager.config = config
+}
+
+// 是否启用
+func (manager *TalkerManager) isOn() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.config.On
+}
+
+// 记录请求的客户端IP、消费者和User-Agent
+func (manager *TalkerManager) send(path string, request *http.Request, consumer string) {
+	if !manager.isOn() {
+		return
+	}
+
+	clientIP := request.RemoteAddr
+	if ip := parseRemoteIP(request.RemoteAddr); ip != nil {
+		clientIP = ip.String()
+	}
+
+	userAgent := request.UserAgent()
+	if len(userAgent) > TALKER_MAX_USER_AGENT_LENGTH {
+		userAgent = userAgent[:TALKER_MAX_USER_AGENT_LENGTH]
+	}
+
+	manager.add(path, time.Now(), map[string]string{
+		TALKER_KIND_IP:         clientIP,
+		TALKER_KIND_CONSUMER:   consumer,
+		TALKER_KIND_USER_AGENT: userAgent,
+	})
+}
+
+// 增加计数，值为空的类型不计数
+func (manager *TalkerManager) add(path string, now time.Time, keys map[string]string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if !manager.config.On {
+		return
+	}
+
+	talkers, ok := manager.apis[path]
+	if !ok {
+		talkers = &apiTalkers{}
+		manager.apis[path] = talkers
+	}
+
+	minute := truncateStatTime(now, STAT_GRANULARITY_MINUTE)
+	hour := truncateStatTime(now, STAT_GRANULARITY_HOUR)
+	var minuteBucket, hourBucket *talkerBucket
+	talkers.minutes, minuteBucket = manager.findBucket(talkers.minutes, minute, minute.Add(-time.Hour))
+	talkers.hours, hourBucket = manager.findBucket(talkers.hours, hour, hour.Add(-24*time.Hour))
+
+	for _, bucket := range []*talkerBucket{minuteBucket, hourBucket} {
+		bucket.requests++
+		for kind, key := range keys {
+			if len(key) == 0 {
+				continue
+			}
+			summary, ok := bucket.summaries[kind]
+			if !ok {
+				summary = newTalkerSummary(manager.config.Capacity)
+				bucket.summaries[kind] = summary
+			}
+			summary.add(key)
+		}
+	}
+}
+
+// 查找某个时间段，不存在时创建，同时删除expiresAt之前的时间段
+func (manager *TalkerManager) findBucket(buckets []*talkerBucket, start time.Time, expiresAt time.Time) ([]*talkerBucket, *talkerBucket) {
+	if len(buckets) > 0 && buckets[len(buckets)-1].start.Equal(start) {
+		return buckets, buckets[len(buckets)-1]
+	}
+
+	index := 0
+	for index < len(buckets) && buckets[index].start.Before(expiresAt) {
+		index++
+	}
+	buckets = buckets[index:]
+
+	bucket := &talkerBucket{
+		start:     start,
+		summaries: map[string]*TalkerSummary{},
+	}
+	return append(buckets, bucket), bucket
+}
+
+// 取得某个时间范围内计数最多的客户端，path为空时合并所有API
+// minute为最近1到2分钟，hour为最近60到61分钟，day为最近24到25小时
+func (manager *TalkerManager) top(path string, kind string, window string, size int, now time.Time) (Map, error) {
+	switch kind {
+	case TALKER_KIND_IP, TALKER_KIND_CONSUMER, TALKER_KIND_USER_AGENT:
+	default:
+		return nil, errors.New("invalid kind '" + kind + "'")
+	}
+
+	var duration time.Duration
+	switch window {
+	case TALKER_WINDOW_MINUTE:
+		duration = time.Minute
+	case TALKER_WINDOW_HOUR:
+		duration = time.Hour
+	case TALKER_WINDOW_DAY:
+		duration = 24 * time.Hour
+	default:
+		return nil, errors.New("invalid window '" + window + "'")
+	}
+	from := now.Add(-duration)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if !manager.config.On {
+		return nil, errors.New("talkers tracking is not enabled")
+	}
+
+	var requests int64 = 0
+	counters := map[string]*TalkerCounter{}
+	for apiPath, talkers := range manager.apis {
+		if len(path) > 0 && apiPath != path {
+			continue
+		}
+
+		buckets, granularity := talkers.minutes, time.Minute
+		if window == TALKER_WINDOW_DAY {
+			buckets, granularity = talkers.hours, time.Hour
+		}
+		for _, bucket := range buckets {
+			if !bucket.start.Add(granularity).After(from) || bucket.start.After(now) {
+				continue
+			}
+
+			requests += bucket.requests
+			summary, ok := bucket.summaries[kind]
+			if !ok {
+				continue
+			}
+			for key, counter := range summary.counters {
+				total, ok := counters[key]
+				if !ok {
+					total = &TalkerCounter{
+						Key: key,
+					}
+					counters[key] = total
+				}
+				total.Count += counter.Count
+				total.Error += counter.Error
+			}
+		}
+	}
+
+	list := []*TalkerCounter{}
+	for _, counter := range counters {
+		list = append(list, counter)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count == list[j].Count {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].Count > list[j].Count
+	})
+	if len(list) > size {
+		list = list[:size]
+	}
+
+	items := []Map{}
+	for _, counter := range list {
+		percent := 0.0
+		if requests > 0 {
+			percent = float64(counter.Count) * 100 / float64(requests)
+		}
+		items = append(items, Map{
+			"name":     counter.Key,
+			"requests": counter.Count,
+			"error":    counter.Error,
+			"percent":  percent,
+		})
+	}
+
+	return Map{
+		"kind":     kind,
+		"window":   window,
+		"requests": requests,
+		"items":    items,
+	}, nil
+}
@@ -0,0 +1,576 @@
+package MeloyApi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	mathRand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 导出方式
+const (
+	TRACING_EXPORTER_OTLP   = "otlp"
+	TRACING_EXPORTER_FILE   = "file"
+	TRACING_EXPORTER_STDOUT = "stdout"
+)
+
+// Span类型，和OTLP中的定义一致
+const (
+	TRACE_SPAN_KIND_INTERNAL = 1
+	TRACE_SPAN_KIND_SERVER   = 2
+	TRACE_SPAN_KIND_CLIENT   = 3
+)
+
+// Span状态，和OTLP中的定义一致
+const (
+	TRACE_STATUS_UNSET = 0
+	TRACE_STATUS_OK    = 1
+	TRACE_STATUS_ERROR = 2
+)
+
+const TRACING_DEFAULT_ENDPOINT = "http://127.0.0.1:4318/v1/traces"
+const TRACING_DEFAULT_SERVICE_NAME = "meloy-api"
+
+// W3C Trace Context报头
+const TRACEPARENT_HEADER = "traceparent"
+
+// 等待导出的Span数量，超出后丢弃
+const TRACING_QUEUE_SIZE = 8192
+
+// 每批导出的最大Span数量
+const TRACING_BATCH_SIZE = 512
+
+// 链路追踪配置
+type TracingConfig struct {
+	On          bool              `json:"on"`          // 是否启用
+	ServiceName string            `json:"serviceName"` // 服务名称，默认为meloy-api
+	SampleRate  float64           `json:"sampleRate"`  // 采样比例，0-1之间，默认为1；上游已经决定是否采样的以上游为准
+	Exporter    string            `json:"exporter"`    // 导出方式：otlp（默认）, file, stdout
+	Endpoint    string            `json:"endpoint"`    // OTLP/HTTP地址，默认为http://127.0.0.1:4318/v1/traces
+	Headers     map[string]string `json:"headers"`     // 发送到OTLP/HTTP地址时附加的报头
+	File        string            `json:"file"`        // 导出到文件时的文件名，相对于logs/目录，默认为traces.log
+}
+
+// 链路
+type Trace struct {
+	TraceId [16]byte
+	Sampled bool
+
+	spans      []*TraceSpan
+	isExported bool
+	mutex      sync.Mutex
+}
+
+// 链路中的一个Span
+type TraceSpan struct {
+	SpanId       [8]byte
+	ParentSpanId [8]byte
+	Name         string
+	Kind         int
+	StartedAt    time.Time
+	EndedAt      time.Time
+	Attributes   Map
+
+	StatusCode    int
+	StatusMessage string
+
+	trace *Trace
+}
+
+// 链路追踪管理器
+type TracingManager struct {
+	config     TracingConfig
+	sampleRate float64
+	file       *os.File
+
+	queue   chan *TraceSpan
+	flushes chan chan bool
+	drops   int64
+
+	mutex sync.Mutex
+}
+
+type traceContextKey string
+
+const traceSpanContextKey traceContextKey = "span"
+const traceRouteSpanContextKey traceContextKey = "route"
+
+var tracingManager = TracingManager{}
+
+var tracingClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// 重新加载配置
+func (manager *TracingManager) reload() {
+	config := appConfig.Tracing
+
+	config.Exporter = strings.ToLower(config.Exporter)
+	if config.Exporter != TRACING_EXPORTER_FILE && config.Exporter != TRACING_EXPORTER_STDOUT {
+		config.Exporter = TRACING_EXPORTER_OTLP
+	}
+	if len(config.ServiceName) == 0 {
+		config.ServiceName = TRACING_DEFAULT_SERVICE_NAME
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = TRACING_DEFAULT_ENDPOINT
+	}
+	if len(config.File) == 0 {
+		config.File = "traces.log"
+	}
+
+	sampleRate := config.SampleRate
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+
+	// 先导出原来配置下的数据
+	manager.flush()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.queue == nil {
+		manager.queue = make(chan *TraceSpan, TRACING_QUEUE_SIZE)
+		manager.flushes = make(chan chan bool)
+		go manager.loop()
+	}
+
+	if manager.file != nil {
+		manager.file.Close()
+		manager.file = nil
+	}
+
+	manager.config = config
+	manager.sampleRate = sampleRate
+
+	if config.On && config.Exporter == TRACING_EXPORTER_FILE {
+		file, err := os.OpenFile(appManager.AppDir+string(os.PathSeparator)+"logs"+string(os.PathSeparator)+config.File, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		} else {
+			manager.file = file
+		}
+	}
+}
+
+// 包装Handler，为每个请求创建根Span，并创建路由Span直到开始处理请求
+func (manager *TracingManager) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		span := manager.begin(request)
+		if span == nil {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		statusWriter := newStatusWriter(writer)
+		routeSpan := span.child("route", TRACE_SPAN_KIND_INTERNAL)
+		ctx := context.WithValue(request.Context(), traceSpanContextKey, span)
+		ctx = context.WithValue(ctx, traceRouteSpanContextKey, routeSpan)
+		request = request.WithContext(ctx)
+
+		handler.ServeHTTP(statusWriter, request)
+
+		routeSpan.end()
+		span.setAttribute("http.status_code", statusWriter.status())
+		if statusWriter.status() >= http.StatusInternalServerError {
+			span.setStatus(TRACE_STATUS_ERROR, http.StatusText(statusWriter.status()))
+		}
+		span.end()
+	})
+}
+
+// 开始一个链路，没有启用时返回nil
+func (manager *TracingManager) begin(request *http.Request) *TraceSpan {
+	manager.mutex.Lock()
+	isOn := manager.config.On
+	sampleRate := manager.sampleRate
+	manager.mutex.Unlock()
+
+	if !isOn {
+		return nil
+	}
+
+	trace := &Trace{}
+	var parentSpanId [8]byte
+
+	// 继续上游的链路
+	traceId, spanId, sampled, ok := parseTraceparent(request.Header.Get(TRACEPARENT_HEADER))
+	if ok {
+		trace.TraceId = traceId
+		trace.Sampled = sampled
+		parentSpanId = spanId
+	} else {
+		trace.TraceId = generateTraceId()
+		trace.Sampled = sampleRate >= 1 || mathRand.Float64() < sampleRate
+	}
+
+	span := trace.startSpan("HTTP "+request.Method, TRACE_SPAN_KIND_SERVER, parentSpanId)
+	span.setAttribute("http.method", request.Method)
+	span.setAttribute("http.target", request.RequestURI)
+	span.setAttribute("http.user_agent", request.UserAgent())
+	if ip := parseRemoteIP(request.RemoteAddr); ip != nil {
+		span.setAttribute("net.peer.ip", ip.String())
+	}
+	return span
+}
+
+// 导出Span
+func (manager *TracingManager) export(spans []*TraceSpan) {
+	for _, span := range spans {
+		select {
+		case manager.queue <- span:
+		default:
+			manager.mutex.Lock()
+			manager.drops++
+			manager.mutex.Unlock()
+		}
+	}
+}
+
+// 定时批量导出
+func (manager *TracingManager) loop() {
+	ticker := time.NewTicker(5 * time.Second)
+	batch := []*TraceSpan{}
+	for {
+		select {
+		case span := <-manager.queue:
+			batch = append(batch, span)
+			if len(batch) >= TRACING_BATCH_SIZE {
+				manager.send(batch)
+				batch = []*TraceSpan{}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				manager.send(batch)
+				batch = []*TraceSpan{}
+			}
+		case done := <-manager.flushes:
+			for len(manager.queue) > 0 {
+				batch = append(batch, <-manager.queue)
+				if len(batch) >= TRACING_BATCH_SIZE {
+					manager.send(batch)
+					batch = []*TraceSpan{}
+				}
+			}
+			if len(batch) > 0 {
+				manager.send(batch)
+				batch = []*TraceSpan{}
+			}
+			done <- true
+		}
+	}
+}
+
+// 导出所有等待中的Span，在关闭程序前调用
+func (manager *TracingManager) flush() {
+	manager.mutex.Lock()
+	flushes := manager.flushes
+	manager.mutex.Unlock()
+
+	if flushes == nil {
+		return
+	}
+
+	done := make(chan bool, 1)
+	select {
+	case flushes <- done:
+	case <-time.After(10 * time.Second):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+// 发送一批Span
+func (manager *TracingManager) send(batch []*TraceSpan) {
+	manager.mutex.Lock()
+	config := manager.config
+	manager.mutex.Unlock()
+
+	data, err := json.Marshal(encodeOTLPSpans(config.ServiceName, batch))
+	if err != nil {
+		log.Println("Error:" + err.Error())
+		return
+	}
+
+	switch config.Exporter {
+	case TRACING_EXPORTER_STDOUT:
+		os.Stdout.Write(append(data, '\n'))
+	case TRACING_EXPORTER_FILE:
+		manager.mutex.Lock()
+		if manager.file != nil {
+			_, err = manager.file.Write(append(data, '\n'))
+		}
+		manager.mutex.Unlock()
+		if err != nil {
+			log.Println("Error:" + err.Error())
+		}
+	default:
+		request, err := http.NewRequest(http.MethodPost, config.Endpoint, bytes.NewReader(data))
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		for key, value := range config.Headers {
+			request.Header.Set(key, value)
+		}
+
+		response, err := tracingClient.Do(request)
+		if err != nil {
+			log.Println("Error:" + err.Error())
+			return
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			log.Println("Error: trace exporter return ", response.Status)
+		}
+	}
+}
+
+// 取得请求的根Span
+func findTraceSpan(request *http.Request) *TraceSpan {
+	if request == nil {
+		return nil
+	}
+	span, ok := request.Context().Value(traceSpanContextKey).(*TraceSpan)
+	if !ok {
+		return nil
+	}
+	return span
+}
+
+// 结束路由Span，在开始处理请求时调用
+func finishTraceRoute(request *http.Request, api string) {
+	span := findTraceSpan(request)
+	if span == nil {
+		return
+	}
+
+	span.setName(request.Method + " " + api)
+	span.setAttribute("meloy.api", api)
+
+	routeSpan, ok := request.Context().Value(traceRouteSpanContextKey).(*TraceSpan)
+	if ok {
+		routeSpan.setAttribute("meloy.api", api)
+		routeSpan.end()
+	}
+}
+
+// 分析traceparent报头，格式为：版本-链路ID-父Span ID-标志
+func parseTraceparent(value string) (traceId [16]byte, spanId [8]byte, sampled bool, ok bool) {
+	pieces := strings.Split(strings.TrimSpace(value), "-")
+	if len(pieces) < 4 || len(pieces[0]) != 2 || pieces[0] == "ff" || len(pieces[1]) != 32 || len(pieces[2]) != 16 || len(pieces[3]) != 2 {
+		return
+	}
+	if pieces[0] == "00" && len(pieces) != 4 {
+		return
+	}
+
+	_, err := hex.Decode(traceId[:], []byte(pieces[1]))
+	if err != nil || traceId == [16]byte{} {
+		return
+	}
+	_, err = hex.Decode(spanId[:], []byte(pieces[2]))
+	if err != nil || spanId == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(pieces[3], 16, 8)
+	if err != nil {
+		return
+	}
+
+	sampled = flags&1 == 1
+	ok = true
+	return
+}
+
+// 生成链路ID
+func generateTraceId() (traceId [16]byte) {
+	rand.Read(traceId[:])
+	return
+}
+
+// 生成Span ID
+func generateSpanId() (spanId [8]byte) {
+	rand.Read(spanId[:])
+	return
+}
+
+// 开始一个Span
+func (trace *Trace) startSpan(name string, kind int, parentSpanId [8]byte) *TraceSpan {
+	return &TraceSpan{
+		SpanId:       generateSpanId(),
+		ParentSpanId: parentSpanId,
+		Name:         name,
+		Kind:         kind,
+		StartedAt:    time.Now(),
+		Attributes:   Map{},
+		trace:        trace,
+	}
+}
+
+// 开始子Span
+func (span *TraceSpan) child(name string, kind int) *TraceSpan {
+	if span == nil {
+		return nil
+	}
+	return span.trace.startSpan(name, kind, span.SpanId)
+}
+
+// 修改名称
+func (span *TraceSpan) setName(name string) {
+	if span == nil {
+		return
+	}
+	span.Name = name
+}
+
+// 设置属性
+func (span *TraceSpan) setAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.Attributes[key] = value
+}
+
+// 设置状态
+func (span *TraceSpan) setStatus(code int, message string) {
+	if span == nil {
+		return
+	}
+	span.StatusCode = code
+	span.StatusMessage = message
+}
+
+// 生成传递给下游的traceparent
+func (span *TraceSpan) traceparent() string {
+	flags := "00"
+	if span.trace.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(span.trace.TraceId[:]) + "-" + hex.EncodeToString(span.SpanId[:]) + "-" + flags
+}
+
+// 结束Span，根Span结束时导出整个链路，之后结束的Span（比如异步请求）单独导出
+func (span *TraceSpan) end() {
+	if span == nil || !span.EndedAt.IsZero() {
+		return
+	}
+	span.EndedAt = time.Now()
+
+	trace := span.trace
+	if !trace.Sampled {
+		return
+	}
+
+	trace.mutex.Lock()
+	if trace.isExported {
+		trace.mutex.Unlock()
+		tracingManager.export([]*TraceSpan{span})
+		return
+	}
+	trace.spans = append(trace.spans, span)
+
+	isRoot := span.Kind == TRACE_SPAN_KIND_SERVER
+	var spans []*TraceSpan
+	if isRoot {
+		trace.isExported = true
+		spans = trace.spans
+		trace.spans = nil
+	}
+	trace.mutex.Unlock()
+
+	if isRoot {
+		tracingManager.export(spans)
+	}
+}
+
+// 转换为OTLP/HTTP的JSON格式
+func encodeOTLPSpans(serviceName string, spans []*TraceSpan) Map {
+	otlpSpans := []Map{}
+	for _, span := range spans {
+		otlpSpan := Map{
+			"traceId":           hex.EncodeToString(span.trace.TraceId[:]),
+			"spanId":            hex.EncodeToString(span.SpanId[:]),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.StartedAt.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.EndedAt.UnixNano(), 10),
+			"attributes":        encodeOTLPAttributes(span.Attributes),
+			"status": Map{
+				"code":    span.StatusCode,
+				"message": span.StatusMessage,
+			},
+		}
+		if span.ParentSpanId != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(span.ParentSpanId[:])
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return Map{
+		"resourceSpans": []Map{
+			{
+				"resource": Map{
+					"attributes": encodeOTLPAttributes(Map{
+						"service.name": serviceName,
+					}),
+				},
+				"scopeSpans": []Map{
+					{
+						"scope": Map{
+							"name":    "meloy-api",
+							"version": MELOY_API_VERSION,
+						},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// 转换为OTLP属性
+func encodeOTLPAttributes(attributes Map) []Map {
+	result := []Map{}
+	for key, value := range attributes {
+		var otlpValue Map
+		switch v := value.(type) {
+		case bool:
+			otlpValue = Map{"boolValue": v}
+		case int:
+			otlpValue = Map{"intValue": strconv.Itoa(v)}
+		case int64:
+			otlpValue = Map{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			otlpValue = Map{"doubleValue": v}
+		case string:
+			otlpValue = Map{"stringValue": v}
+		default:
+			data, _ := json.Marshal(v)
+			otlpValue = Map{"stringValue": string(data)}
+		}
+		result = append(result, Map{
+			"key":   key,
+			"value": otlpValue,
+		})
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package MeloyApi
+
+import (
+	"net/http"
+)
+
+// 记录响应状态码和字节数的ResponseWriter
+type StatusWriter struct {
+	http.ResponseWriter
+
+	StatusCode int
+	Bytes      int64
+}
+
+// 包装ResponseWriter
+func newStatusWriter(writer http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{
+		ResponseWriter: writer,
+	}
+}
+
+// 写入状态码
+func (writer *StatusWriter) WriteHeader(statusCode int) {
+	if writer.StatusCode == 0 {
+		writer.StatusCode = statusCode
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+// 写入内容
+func (writer *StatusWriter) Write(data []byte) (int, error) {
+	if writer.StatusCode == 0 {
+		writer.StatusCode = http.StatusOK
+	}
+	n, err := writer.ResponseWriter.Write(data)
+	writer.Bytes += int64(n)
+	return n, err
+}
+
+// 取得状态码，没有写入任何内容时为200
+func (writer *StatusWriter) status() int {
+	if writer.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return writer.StatusCode
+}